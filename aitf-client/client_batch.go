@@ -0,0 +1,73 @@
+package main
+
+import (
+	"log"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/ThomasJClark/cs4404project/aitf/filter"
+)
+
+/*
+batches holds the filter requests that are waiting to be sent to each gateway.
+During a distributed attack, requests for every attacker seen within a short
+window are sent together in one message, instead of one message per attacker.
+*/
+var batches = make(map[string][]filter.Request)
+var batchesMutex sync.Mutex
+
+/*maxBatch is the most filter requests sent in one message.  It can be set
+lower than filter.MaxBatchSize for gateways that only allow smaller bursts of
+requests, since they refuse batches that are bigger than that.*/
+var maxBatch = filter.MaxBatchSize
+
+/*
+queueRequest adds a filter request to the batch for the given gateway.  The
+batch is sent once window is over, or right away once it's full.
+*/
+func queueRequest(req filter.Request, gateway net.IP, window time.Duration) {
+	batchesMutex.Lock()
+	defer batchesMutex.Unlock()
+
+	batch := batches[gateway.String()]
+	for _, queued := range batch {
+		if queued.Key() == req.Key() {
+			return
+		}
+	}
+
+	if len(batch) == 0 {
+		time.AfterFunc(window, func() {
+			batchesMutex.Lock()
+			defer batchesMutex.Unlock()
+
+			sendBatch(gateway)
+		})
+	}
+
+	batches[gateway.String()] = append(batch, req)
+	if len(batches[gateway.String()]) >= maxBatch {
+		sendBatch(gateway)
+	}
+}
+
+/*sendBatch sends every filter request waiting for a gateway in one message.
+The caller must hold batchesMutex.*/
+func sendBatch(gateway net.IP) {
+	batch := batches[gateway.String()]
+	if len(batch) == 0 {
+		return
+	}
+
+	delete(batches, gateway.String())
+
+	req, err := filter.NewBatch(batch)
+	if err != nil {
+		log.Println(err)
+		return
+	}
+
+	log.Println("Sending", len(batch), "filter requests at once")
+	endpoint.Send(req, gateway)
+}
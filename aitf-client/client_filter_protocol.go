@@ -1,9 +1,9 @@
 package main
 
 import (
-	"bytes"
 	"log"
 	"net"
+	"sync"
 	"time"
 
 	"code.google.com/p/gopacket/layers"
@@ -21,6 +21,19 @@ const (
 	lie
 )
 
+var endpoint *filter.Endpoint
+var filters = filter.NewTable(false)
+
+/*renewal is a timer for renewing a filter request periodically.*/
+type renewal struct {
+	timer *time.Timer
+}
+
+/*renewals holds the renewal of each flow that's being renewed, so that a flow
+is only renewed once per interval no matter how many requests are sent for it.*/
+var renewals = make(map[filter.FlowKey]*renewal)
+var renewalsMutex sync.Mutex
+
 /*
 listenForFilterRequest waits for a filter request from a router to come.  Then,
 it verifies the authenticity of the request and takes some action.
@@ -32,27 +45,9 @@ If action is ignore, it logs the request but does nothing about it.comply
 If action is lie, it complies with the request but doesn't actually add a filter.
 */
 func listenForFilterRequest(mode complianceMode) {
-	/*Open up a UDP server on the filter request port and handle any messages
-	that arrive.*/
-	serverAddr, err := net.ResolveUDPAddr("udp", ":54321")
-	if err != nil {
-		log.Fatal(err)
-	}
-
-	serverConn, err := net.ListenUDP("udp", serverAddr)
-	if err != nil {
-		log.Fatal(err)
-	}
-
-	defer serverConn.Close()
-
-	buf := make([]byte, 5000)
 	for {
-		n, addr, _ := serverConn.ReadFromUDP(buf)
-
-		/*Read a request from the UDP connection*/
-		var req filter.Request
-		_, err := req.ReadFrom(bytes.NewBuffer(buf[:n]))
+		/*Read a request from the control socket*/
+		req, addr, err := endpoint.Receive()
 		if err != nil {
 			log.Println(err)
 			continue
@@ -66,10 +61,19 @@ func listenForFilterRequest(mode complianceMode) {
 				log.Println("Complying with filter request...")
 
 				/*If this host is okay with filter requests, add a firewall rule to
-				block the requested flow and respond with an acknowledgement.*/
-				filter.InstallFilter(req, filter.LongFilterTime, false)
+				block the requested flow and respond with an acknowledgement.  If
+				there's no room for another rule, say so, and the gateway will
+				filter the flow itself.*/
+				if err := filters.Install(req, filter.LongFilterTime, filter.PriorityNormal); err != nil {
+					log.Println("Can't filter", req.Key(), "-", err)
+					req.Type = filter.FilterRefused
+					req.Reason = filter.ReasonNoCapacity
+					endpoint.SendTo(req, addr)
+					break
+				}
+
 				req.Type = filter.FilterAck
-				req.Send(addr.IP)
+				endpoint.SendTo(req, addr)
 
 			case ignore:
 				log.Println("Ignoring filter request...")
@@ -80,20 +84,103 @@ func listenForFilterRequest(mode complianceMode) {
 				/*If this host is a lier, send an acknowledgement without actually
 				installing a filter rule.*/
 				req.Type = filter.FilterAck
-				req.Send(addr.IP)
+				endpoint.SendTo(req, addr)
+			}
+
+		case filter.FilterRenew:
+			/*The victim still wants the flow blocked, so keep the filter for longer.
+			If it's already timed out, just put it back.*/
+			if mode == comply {
+				if _, ok := filters.Renew(req.Key()); !ok {
+					filters.Install(req, filter.LongFilterTime, filter.PriorityNormal)
+				}
+			}
+
+		case filter.FilterRevoke:
+			/*The victim doesn't want the flow blocked anymore.*/
+			if mode == comply {
+				filters.Remove(req.Key())
 			}
 
 		case filter.FilterAck:
-			/*Do nothing.  The routers should take care of mitigating the attack from
-			now on.*/
+			/*The routers should take care of mitigating the attack from now on, but
+			keep an eye out in case they don't.*/
+			requestAcked(req, addr.IP)
+
+		case filter.FilterRefused, filter.FilterError:
+			/*The gateway won't handle the request, so there's no point waiting for
+			the attack to stop.*/
+			log.Println("Filter request for", req.Key(), "was not accepted:", req.Reason)
+			requestRefused(req, addr.IP)
 
 		default:
 			/*Hosts shouldn't get any of the other message types.*/
 			log.Println("Unexpected filter request:", req)
+			req.Type = filter.FilterError
+			req.Reason = filter.ReasonUnexpectedMessage
+			endpoint.SendTo(req, addr)
 		}
 	}
 }
 
+/*revokeFilter withdraws a filter request that was sent to the given gateway,
+removing the filter everywhere along the path.*/
+func revokeFilter(req filter.Request, gateway net.IP) {
+	log.Println("Revoking filter request for", req.Key())
+
+	stopRenewing(req.Key())
+	forgetRequest(req.Key())
+
+	req.Type = filter.FilterRevoke
+	endpoint.Send(req, gateway)
+}
+
+/*
+renewFilterPeriodically renews a filter request that was sent to the given
+gateway at the given interval, until the request is revoked or forgotten.
+*/
+func renewFilterPeriodically(req filter.Request, gateway net.IP, every time.Duration) {
+	key := req.Key()
+
+	renewalsMutex.Lock()
+	defer renewalsMutex.Unlock()
+
+	if renewals[key] != nil {
+		return
+	}
+
+	r := &renewal{}
+	var renew func()
+	renew = func() {
+		renewalsMutex.Lock()
+		defer renewalsMutex.Unlock()
+
+		/*Stop if the request was revoked in the meantime.*/
+		if renewals[key] != r {
+			return
+		}
+
+		req.Type = filter.FilterRenew
+		endpoint.Send(req, gateway)
+		r.timer = time.AfterFunc(every, renew)
+	}
+
+	r.timer = time.AfterFunc(every, renew)
+	renewals[key] = r
+}
+
+/*stopRenewing stops renewing the filter request for a flow, if it's being
+renewed.*/
+func stopRenewing(key filter.FlowKey) {
+	renewalsMutex.Lock()
+	defer renewalsMutex.Unlock()
+
+	if r := renewals[key]; r != nil {
+		r.timer.Stop()
+		delete(renewals, key)
+	}
+}
+
 /*
 Spam cleverly-constructed fake filter requests to block "from". These should be
 dropped by the router, as they do not have legitimate nonces.
@@ -120,6 +207,6 @@ func sendFakeRequests(from, to net.IP) {
 
 	for _ = range time.Tick(time.Second) {
 		log.Println("Sending illigitimate filter request:", req)
-		req.Send(req.Flow.Path[0].IP)
+		endpoint.Send(req, req.Flow.Path[0].IP)
 	}
 }
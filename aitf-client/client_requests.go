@@ -0,0 +1,206 @@
+package main
+
+import (
+	"log"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/ThomasJClark/cs4404project/aitf"
+	"github.com/ThomasJClark/cs4404project/aitf/filter"
+)
+
+/*
+ackGracePeriod is how long attack traffic can keep arriving after a filter
+request is acknowledged before we decide the attack didn't stop.  Packets that
+were already on their way when the filter went up shouldn't count.
+*/
+var ackGracePeriod = 500 * time.Millisecond
+
+/*maxAttempts is how many times a flow is requested, including the first time,
+before the request is reported as failed.*/
+var maxAttempts = 3
+
+/*
+requestTimeout is how long to wait for the gateway to answer a filter request
+before sending it again.  Until then, more malicious packets on the same flow
+don't cause any more requests, so a flood of attack traffic doesn't turn into a
+flood of control traffic.
+*/
+var requestTimeout = time.Second
+
+/*outstandingRequest is a filter request that we're waiting to see work.*/
+type outstandingRequest struct {
+	req      filter.Request
+	gateway  net.IP
+	sent     time.Time /*When it was last sent*/
+	acked    time.Time /*When the gateway last acknowledged it, or zero*/
+	attempts int
+	failed   bool
+}
+
+/*outstanding holds the filter request for each flow that we've asked to have
+blocked.*/
+var outstanding = make(map[filter.FlowKey]*outstandingRequest)
+var outstandingMutex sync.Mutex
+
+/*
+requestFilter is called for every malicious packet, and asks the gateway to
+block its flow if we haven't already.  It returns true if this is a new request.
+
+There's at most one request outstanding for each flow.  If the gateway doesn't
+answer it within requestTimeout, it's sent again.
+
+If the flow was already acknowledged and the attack keeps coming anyway, the
+request is sent again with a hint that the gateway should escalate it.  After
+maxAttempts, the request is reported as failed and given up on.  Once the
+filter would have expired anyway, new attack traffic counts as a new attack.
+*/
+func requestFilter(req filter.Request, gateway net.IP, batchWindow time.Duration) bool {
+	key := req.Key()
+
+	outstandingMutex.Lock()
+	defer outstandingMutex.Unlock()
+
+	o := outstanding[key]
+	if o != nil && !o.acked.IsZero() && time.Since(o.acked) > filter.LongFilterTime {
+		o = nil
+	}
+
+	if o == nil {
+		o = &outstandingRequest{req: req, gateway: gateway, sent: time.Now(), attempts: 1}
+		outstanding[key] = o
+		sendRequest(req, gateway, batchWindow)
+		return true
+	}
+
+	if o.failed {
+		return false
+	}
+
+	/*Keep asking until the gateway answers, but only once per timeout.*/
+	if o.acked.IsZero() {
+		if time.Since(o.sent) < requestTimeout {
+			return false
+		}
+
+		if o.attempts >= maxAttempts {
+			log.Println("Filter request for", key, "failed. The gateway never answered after", o.attempts, "attempts.")
+			o.failed = true
+			return false
+		}
+
+		o.attempts++
+		o.sent = time.Now()
+		log.Println("No answer about", key, "within", requestTimeout, "- asking again, attempt", o.attempts)
+		sendRequest(o.req, gateway, batchWindow)
+		return false
+	}
+
+	if time.Since(o.acked) < ackGracePeriod {
+		return false
+	}
+
+	if o.attempts >= maxAttempts {
+		log.Println("Filter request for", key, "failed. The attack is still going after", o.attempts, "attempts.")
+		o.failed = true
+		return false
+	}
+
+	o.attempts++
+	o.acked = time.Time{}
+	log.Println("The attack from", aitf.Hostname(req.SrcIP), "didn't stop. Asking again, attempt", o.attempts)
+
+	req.Reason = filter.ReasonAttackPersists
+	o.req = req
+	o.sent = time.Now()
+	sendRequest(req, gateway, batchWindow)
+	return false
+}
+
+/*sendRequest sends a filter request to the gateway, either right away or in a
+batch with other requests.  Requests with an escalation hint are always sent
+right away, since the hint applies to every flow in a batch.*/
+func sendRequest(req filter.Request, gateway net.IP, batchWindow time.Duration) {
+	if batchWindow != 0 && req.Reason == filter.ReasonNone {
+		queueRequest(req, gateway, batchWindow)
+	} else {
+		endpoint.Send(req, gateway)
+	}
+}
+
+/*requestAcked records that the gateway acknowledged the requests for the flows
+in an ACK.*/
+func requestAcked(ack filter.Request, from net.IP) {
+	outstandingMutex.Lock()
+	defer outstandingMutex.Unlock()
+
+	for _, key := range ack.Keys() {
+		if o := outstanding[key]; o != nil && o.gateway.Equal(from) {
+			o.acked = time.Now()
+		}
+	}
+}
+
+/*
+requestRefused records that the gateway won't handle the requests for the flows
+in a refusal.  If it might work later, such as when the gateway was just too
+busy, the request is treated as unanswered, so it's only sent again once
+requestTimeout is over, and only up to maxAttempts times.  Otherwise, it's
+reported as failed.
+*/
+func requestRefused(refusal filter.Request, from net.IP) {
+	outstandingMutex.Lock()
+	defer outstandingMutex.Unlock()
+
+	for _, key := range refusal.Keys() {
+		o := outstanding[key]
+		if o == nil || !o.gateway.Equal(from) {
+			continue
+		}
+
+		switch refusal.Reason {
+		case filter.ReasonRateLimited, filter.ReasonNoCapacity:
+			o.acked = time.Time{}
+			o.sent = time.Now()
+		default:
+			log.Println("Filter request for", key, "failed:", refusal.Reason)
+			o.failed = true
+		}
+	}
+}
+
+/*
+forgetRequestsPeriodically stops tracking requests once the filters they asked
+for would have expired, so the table doesn't grow forever.  New attack traffic
+on those flows is treated as a new attack.
+
+Since no attack traffic has come in for that long, the attack is assumed to be
+over, and the filters stop being renewed.  Otherwise, every flow would be
+renewed forever, and end up blocked for MaxFilterTime at a time.
+*/
+func forgetRequestsPeriodically() {
+	for _ = range time.Tick(filter.LongFilterTime) {
+		outstandingMutex.Lock()
+		for key, o := range outstanding {
+			last := o.sent
+			if o.acked.After(last) {
+				last = o.acked
+			}
+
+			if time.Since(last) > filter.LongFilterTime {
+				delete(outstanding, key)
+				stopRenewing(key)
+			}
+		}
+		outstandingMutex.Unlock()
+	}
+}
+
+/*forgetRequest stops tracking the request for a flow, after it's revoked.*/
+func forgetRequest(key filter.FlowKey) {
+	outstandingMutex.Lock()
+	defer outstandingMutex.Unlock()
+
+	delete(outstanding, key)
+}
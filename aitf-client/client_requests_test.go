@@ -0,0 +1,101 @@
+package main
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/ThomasJClark/cs4404project/aitf/filter"
+)
+
+/*testStep is a malicious packet arriving at the client, after setting up the
+request for its flow with before.*/
+type testStep struct {
+	name     string
+	before   func(o *outstandingRequest)
+	isNew    bool
+	attempts int
+	failed   bool
+	reason   filter.Reason
+}
+
+func runSteps(t *testing.T, steps []testStep) {
+	var err error
+	if endpoint, err = filter.NewEndpoint("127.0.0.1", 0); err != nil {
+		t.Fatal(err)
+	}
+
+	defer endpoint.Close()
+
+	gateway := net.ParseIP("127.0.0.1")
+	req := filter.Request{Type: filter.FilterReq, SrcIP: net.ParseIP("10.4.32.4"), DstIP: net.ParseIP("10.4.31.2")}
+	forgetRequest(req.Key())
+
+	for _, step := range steps {
+		if o := outstanding[req.Key()]; o != nil && step.before != nil {
+			step.before(o)
+		}
+
+		if isNew := requestFilter(req, gateway, 0); isNew != step.isNew {
+			t.Errorf("%s: requestFilter() = %v, want %v", step.name, isNew, step.isNew)
+		}
+
+		o := outstanding[req.Key()]
+		if o.attempts != step.attempts || o.failed != step.failed || o.req.Reason != step.reason {
+			t.Errorf("%s: %d attempts, failed %v, reason %q, want %d, %v, %q",
+				step.name, o.attempts, o.failed, o.req.Reason, step.attempts, step.failed, step.reason)
+		}
+	}
+}
+
+/*ackedAgo returns a step setup that pretends the request was last acknowledged d
+ago.*/
+func ackedAgo(d time.Duration) func(o *outstandingRequest) {
+	return func(o *outstandingRequest) { o.acked = time.Now().Add(-d) }
+}
+
+func TestRequestPersistentAttack(t *testing.T) {
+	runSteps(t, []testStep{
+		{"first packet", nil, true, 1, false, filter.ReasonNone},
+		{"in grace period", ackedAgo(0), false, 1, false, filter.ReasonNone},
+		{"after grace period", ackedAgo(2 * ackGracePeriod), false, 2, false, filter.ReasonAttackPersists},
+		{"still persists", ackedAgo(2 * ackGracePeriod), false, 3, false, filter.ReasonAttackPersists},
+		{"out of attempts", ackedAgo(2 * ackGracePeriod), false, 3, true, filter.ReasonAttackPersists},
+		{"filter expired", ackedAgo(2 * filter.LongFilterTime), true, 1, false, filter.ReasonNone},
+	})
+}
+
+/*sentAgo returns a step setup that pretends the request was last sent d ago
+without an answer.*/
+func sentAgo(d time.Duration) func(o *outstandingRequest) {
+	return func(o *outstandingRequest) { o.sent = time.Now().Add(-d) }
+}
+
+/*refused returns a step setup that has the gateway refuse the request for the
+given reason.*/
+func refused(reason filter.Reason) func(o *outstandingRequest) {
+	return func(o *outstandingRequest) {
+		refusal := o.req
+		refusal.Type = filter.FilterRefused
+		refusal.Reason = reason
+		requestRefused(refusal, o.gateway)
+	}
+}
+
+func TestRequestSuppression(t *testing.T) {
+	runSteps(t, []testStep{
+		{"first packet", nil, true, 1, false, filter.ReasonNone},
+		{"before timeout", nil, false, 1, false, filter.ReasonNone},
+		{"still before timeout", sentAgo(requestTimeout / 2), false, 1, false, filter.ReasonNone},
+		{"after timeout", sentAgo(2 * requestTimeout), false, 2, false, filter.ReasonNone},
+		{"rate limited", refused(filter.ReasonRateLimited), false, 2, false, filter.ReasonNone},
+		{"rate limited, after timeout", sentAgo(2 * requestTimeout), false, 3, false, filter.ReasonNone},
+		{"out of attempts", sentAgo(2 * requestTimeout), false, 3, true, filter.ReasonNone},
+	})
+
+	runSteps(t, []testStep{
+		{"first packet", nil, true, 1, false, filter.ReasonNone},
+		{"not owner", refused(filter.ReasonNotOwner), false, 1, true, filter.ReasonNone},
+		{"after timeout", sentAgo(2 * requestTimeout), false, 1, true, filter.ReasonNone},
+	})
+}
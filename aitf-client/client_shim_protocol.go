@@ -3,6 +3,7 @@ package main
 import (
 	"log"
 	"net"
+	"time"
 
 	"code.google.com/p/gopacket/layers"
 	"github.com/ThomasJClark/cs4404project/aitf"
@@ -15,9 +16,13 @@ import (
 removes their route records before letting the operating system process them.
 
 If listenForRouteRecords is true, it also sends filter requests whenever an
-ICMP packet from 10.4.32.4 arrives.
+ICMP packet from 10.4.32.4 arrives.  If renewEvery is non-zero, each request is
+renewed at that interval.  If revokeAfter is non-zero, each request is revoked
+after that long, as if the victim decided it was a false positive.  If
+batchWindow is non-zero, requests made within that long of each other are sent
+together in one message.
 */
-func listenForRouteRecords(sendFilterRequests bool) {
+func listenForRouteRecords(sendFilterRequests bool, renewEvery, revokeAfter, batchWindow time.Duration) {
 	routerecord.Init()
 
 	nfq, err := netfilter.NewNFQueue(0, 100000, 0xffff)
@@ -56,7 +61,16 @@ func listenForRouteRecords(sendFilterRequests bool) {
 						DstIP: ipLayer.DstIP,
 						Flow:  *rr,
 					}
-					req.Send(rr.Path[len(rr.Path)-1].IP)
+					gateway := rr.Path[len(rr.Path)-1].IP
+					if requestFilter(req, gateway, batchWindow) {
+						if renewEvery != 0 {
+							renewFilterPeriodically(req, gateway, renewEvery)
+						}
+
+						if revokeAfter != 0 {
+							time.AfterFunc(revokeAfter, func() { revokeFilter(req, gateway) })
+						}
+					}
 				}
 			}
 
@@ -4,6 +4,8 @@ import (
 	"flag"
 	"log"
 	"net"
+
+	"github.com/ThomasJClark/cs4404project/aitf/filter"
 )
 
 func main() {
@@ -11,10 +13,38 @@ func main() {
 
 	/*Read in the command-line options.*/
 	modeStr := flag.String("mode", "comply", "What to do after receiving a filter request (comply, ignore, or lie)")
+	addr := flag.String("addr", "", "The local address to listen for filter requests on. (default all addresses)")
+	port := flag.Int("port", filter.DefaultPort, "The UDP port used for filter requests.")
+	freshness := flag.Duration("freshness", filter.DefaultFreshness, "How old a message can be before it's rejected as a replay.")
 	sendRequests := flag.Bool("sendRequests", false, "Enable the dummy policy module to send filter request. (true or false)")
+	renewEvery := flag.Duration("renewEvery", 0, "Renew each filter request at the given interval until it's revoked. (0 to never renew)")
+	revokeAfter := flag.Duration("revokeAfter", 0, "Revoke each filter request after the given time, as if it were a false positive. (0 to never revoke)")
+	batchWindow := flag.Duration("batchWindow", 0, "Send all of the filter requests made within this long of each other in one message. (0 to send each one right away)")
+	flag.IntVar(&maxBatch, "maxBatch", maxBatch, "The most filter requests to send in one message. (at most 32)")
+	flag.DurationVar(&ackGracePeriod, "ackGracePeriod", ackGracePeriod, "How long attack traffic can keep arriving after a filter request is acknowledged.")
+	flag.DurationVar(&requestTimeout, "requestTimeout", requestTimeout, "How long to wait for the gateway to answer a filter request before sending it again.")
+	flag.IntVar(&maxAttempts, "maxAttempts", maxAttempts, "How many times to ask for a flow to be filtered before giving up.")
 	fakeRequestVictim := flag.String("fakeRequestVictim", "", "Spam 10.4.32.1 with fake filter requests for the given IP.")
+	flag.IntVar(&filters.Max, "maxFilters", 0, "The most filters that can be installed at once. (0 for no limit)")
+	evict := flag.String("evict", "oldest", "Which filter to remove when the table is full (none, oldest, least-hit, or lowest-priority)")
 	flag.Parse()
 
+	if maxBatch < 1 || maxBatch > filter.MaxBatchSize {
+		log.Fatalf("-maxBatch must be between 1 and %d", filter.MaxBatchSize)
+	}
+
+	var err error
+	if filters.Policy, err = filter.ParseEvictionPolicy(*evict); err != nil {
+		log.Fatal(err)
+	}
+
+	endpoint, err = filter.NewEndpoint(*addr, *port)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	endpoint.Freshness = *freshness
+
 	switch *modeStr {
 	case "ignore":
 		log.Println("Ignoring filtering requests.")
@@ -27,7 +57,8 @@ func main() {
 		go listenForFilterRequest(comply)
 	}
 
-	go listenForRouteRecords(*sendRequests)
+	go forgetRequestsPeriodically()
+	go listenForRouteRecords(*sendRequests, *renewEvery, *revokeAfter, *batchWindow)
 
 	if *fakeRequestVictim != "" {
 		go sendFakeRequests(net.ParseIP(*fakeRequestVictim), net.ParseIP("10.4.32.1"))
@@ -1,8 +1,13 @@
 package main
 
 import (
+	"crypto/ed25519"
 	"flag"
 	"log"
+	"net"
+	"strings"
+
+	"github.com/ThomasJClark/cs4404project/aitf/filter"
 )
 
 func main() {
@@ -10,21 +15,128 @@ func main() {
 
 	/*Read in the command-line options.*/
 	modeStr := flag.String("mode", "comply", "What to do after receiving a filter request (comply, ignore, or lie)")
+	addr := flag.String("addr", "", "The local address to listen for filter requests on. (default all addresses)")
+	port := flag.Int("port", filter.DefaultPort, "The UDP port used for filter requests.")
+	flag.Var(&customers, "customers", "Comma-separated list of the customer networks that this router serves (e.g. 10.4.32.0/28).")
+	flag.Var(&policyServers, "policyServers", "Comma-separated list of hosts or networks that may request filters for any customer (e.g. 10.4.32.5/32).")
+	flag.DurationVar(&disconnectTime, "disconnectTime", disconnectTime, "How long to block all traffic from a customer that lies about complying with a filter request.")
+	flag.DurationVar(&counterConnectionTimeout, "counterConnectionTimeout", counterConnectionTimeout, "How long to wait for a router to take over a filter before asking the next one up the path.")
+	handshakeMode := flag.String("handshake", "stateful", "How to keep track of counter-connection handshakes (stateful or cookie)")
+	maxHandshakes := flag.Int("maxHandshakes", 1024, "The most counter-connection handshakes that can be waiting for an ACK at once in stateful mode.")
+	keysPath := flag.String("keys", "", "A file with the keys of peer routers for signing messages.")
+	signingKeyPath := flag.String("signingKey", "", "A file with this router's Ed25519 private key seed, for peers with ed25519 keys.")
+	flag.BoolVar(&requireSignatures, "requireSignatures", false, "Throw away counter-connection messages from routers without a key.")
+	freshness := flag.Duration("freshness", filter.DefaultFreshness, "How old a message can be before it's rejected as a replay.")
+	flag.Float64Var(&hostLimits.rate, "hostRate", hostLimits.rate, "How many filter requests per second each customer host can make. (0 for no limit)")
+	hostBurst := flag.Int("hostBurst", int(hostLimits.burst), "How many filter requests each customer host can make at once.")
+	flag.Float64Var(&prefixLimits.rate, "prefixRate", prefixLimits.rate, "How many filter requests per second each customer network can make. (0 for no limit)")
+	prefixBurst := flag.Int("prefixBurst", int(prefixLimits.burst), "How many filter requests each customer network can make at once.")
+	flag.IntVar(&peerQuota, "peerQuota", peerQuota, "The most filters that another router can have us handle at once.")
+	flag.Float64Var(&peerLimits.rate, "peerRate", peerLimits.rate, "How many counter-connections per second another router can start. (0 for no limit)")
+	peerBurst := flag.Int("peerBurst", int(peerLimits.burst), "How many counter-connections another router can start at once.")
+	flag.IntVar(&filters.Max, "maxFilters", 0, "The most filters that can be installed at once. (0 for no limit)")
+	evict := flag.String("evict", "lowest-priority", "Which filter to remove when the table is full (none, oldest, least-hit, or lowest-priority)")
+	flag.IntVar(&filters.Aggregation.PrefixLen, "aggregateLen", 24, "The length of the source prefixes that filters to the same victim are combined into. (0 to never combine filters)")
+	flag.IntVar(&filters.Aggregation.Threshold, "aggregateThreshold", 16, "How many filters in a source prefix it takes to combine them.")
+	flag.IntVar(&filters.Aggregation.Release, "aggregateRelease", 4, "How few filters can be left in a combined prefix before it's split up again.")
+	flag.Var(&filters.Aggregation.Exempt, "aggregateExempt", "Comma-separated list of source networks that filters are never combined over.")
+	neighborList := flag.String("neighbors", "", "Comma-separated list of AITF routers to exchange hellos with from the start.")
+	flag.DurationVar(&helloInterval, "helloInterval", helloInterval, "How often to send hellos to neighbouring routers.")
+	statusAddr := flag.String("status", "", "Serve statistics over HTTP on the given address (e.g. :8080).")
 	flag.Parse()
 
+	hostLimits.burst = float64(*hostBurst)
+	prefixLimits.burst = float64(*prefixBurst)
+	peerLimits.burst = float64(*peerBurst)
+
+	if *hostBurst < filter.MaxBatchSize || *prefixBurst < filter.MaxBatchSize {
+		log.Println("Warning: batches of", filter.MaxBatchSize, "flows are bigger than the burst, so they'll always be refused. Clients should use a smaller -maxBatch.")
+	}
+
+	var err error
+	if filters.Policy, err = filter.ParseEvictionPolicy(*evict); err != nil {
+		log.Fatal(err)
+	}
+
+	if err = filters.Aggregation.Validate(); err != nil {
+		log.Fatal(err)
+	}
+
+	/*A prefix filter would drop traffic that a shadow filter is watching for, so
+	we'd never find out if the node that agreed to filter it isn't.*/
+	filters.Aggregation.Skip = shadows.Watching
+
+	endpoint, err = filter.NewEndpoint(*addr, *port)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	if *keysPath != "" {
+		var private ed25519.PrivateKey
+		if *signingKeyPath != "" {
+			if private, err = filter.LoadSigningKey(*signingKeyPath); err != nil {
+				log.Fatal(err)
+			}
+		}
+
+		if keys, err = filter.LoadKeyRing(*keysPath, private); err != nil {
+			log.Fatal(err)
+		}
+
+		log.Println("Signing messages to", keys.Len(), "peer routers.")
+	}
+
+	endpoint.Keys = keys
+	endpoint.Freshness = *freshness
+
+	if len(customers) == 0 {
+		log.Println("No customer networks given. All counter-connections will be refused.")
+	}
+
+	if *statusAddr != "" {
+		go serveStatus(*statusAddr)
+	}
+
+	switch *handshakeMode {
+	case "cookie":
+		log.Println("Using stateless cookies for counter-connections.")
+		handshakes = newCookieHandshaker()
+	default:
+		log.Println("Keeping state for counter-connections.")
+		stateful := newStatefulHandshaker(*maxHandshakes)
+		go stateful.expirePeriodically()
+		handshakes = stateful
+	}
+
+	if *neighborList != "" {
+		for _, s := range strings.Split(*neighborList, ",") {
+			ip := net.ParseIP(strings.TrimSpace(s))
+			if ip == nil {
+				log.Fatalf("invalid neighbor address %q", s)
+			}
+
+			staticNeighbors = append(staticNeighbors, ip)
+		}
+	}
+
 	switch *modeStr {
 	case "ignore":
 		log.Println("Ignoring filtering requests.")
-		go listenForFilterRequest(ignore)
+		localMode = ignore
 	case "lie":
 		log.Println("Pretending to comply with filtering requests.")
-		go listenForFilterRequest(lie)
+		localMode = lie
 	default:
 		log.Println("Complying with filtering requests.")
-		go listenForFilterRequest(comply)
+		localMode = comply
 	}
 
+	go listenForFilterRequest(localMode)
+	go helloPeriodically()
+
 	go addRouteRecords()
+	go handleViolations()
+	go shadows.expirePeriodically()
 
 	select {}
 }
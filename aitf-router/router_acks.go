@@ -0,0 +1,45 @@
+package main
+
+import (
+	"net"
+
+	"github.com/ThomasJClark/cs4404project/aitf/filter"
+)
+
+/*pendingAck records which node is expected to acknowledge a filter, and the
+handshake nonce that it must present when it does.*/
+type pendingAck struct {
+	peer  net.IP
+	nonce uint64
+}
+
+var pendingAcks = make(map[filter.FlowKey]pendingAck)
+
+/*
+expectAck remembers that peer is expected to send a filter ACK for the flow in
+req.  On the victim's router, the peer is the attacker's router that just
+completed a counter-connection.  On the attacker's router, the peer is the
+attacker itself.  In both cases, the ACK must carry the nonce from the
+counter-connection handshake.  For a batch, an ACK is expected for every flow.
+*/
+func expectAck(req filter.Request, peer net.IP) {
+	for _, key := range req.Keys() {
+		pendingAcks[key] = pendingAck{peer: peer, nonce: req.Nonce}
+	}
+}
+
+/*
+checkAck returns true if req is a filter ACK that we were waiting for from the
+given node.  Batched ACKs must be split up with Flows and checked one at a
+time.  A flow is only acknowledged once, so the pending ACK is forgotten after
+it's checked successfully.
+*/
+func checkAck(req filter.Request, from net.IP) bool {
+	pending, ok := pendingAcks[req.Key()]
+	if !ok || !pending.peer.Equal(from) || pending.nonce != req.Nonce {
+		return false
+	}
+
+	delete(pendingAcks, req.Key())
+	return true
+}
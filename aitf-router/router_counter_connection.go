@@ -0,0 +1,276 @@
+package main
+
+import (
+	"log"
+	"net"
+	"time"
+
+	"github.com/ThomasJClark/cs4404project/aitf"
+	"github.com/ThomasJClark/cs4404project/aitf/filter"
+)
+
+/*counterConnection tracks a counter-connection that this router started on
+behalf of one of its customers.  A batched counter-connection is in the map
+once for each of its flows.*/
+type counterConnection struct {
+	req filter.Request
+	hop int /*The index in the route record of the router being asked to filter*/
+}
+
+var counterConnections = make(map[filter.FlowKey]*counterConnection)
+
+/*counterConnectionTimeout is how long the router being asked to filter a flow
+has to acknowledge it.  If it doesn't answer in time, it's assumed to be down or
+not to speak AITF, and the next router up the path is asked instead.*/
+var counterConnectionTimeout = filter.TemporaryFilterTime
+
+/*flow returns the request for one of the flows in a counter-connection.*/
+func (cc *counterConnection) flow(key filter.FlowKey) filter.Request {
+	for _, flow := range cc.req.Flows() {
+		if flow.Key() == key {
+			return flow
+		}
+	}
+
+	return cc.req
+}
+
+/*
+startCounterConnection asks the router at the given index of the route record
+to take over filtering the flow in req.
+
+The last router in the route record is this router, so a counter-connection can
+only be started with the routers before it.  If there's no such router, false is
+returned.
+
+req can be a batch of flows that all have the same router at that index.
+*/
+func startCounterConnection(req filter.Request, hop int) bool {
+	/*Skip routers that told us they won't take over the filters.  A batch might
+	have different routers after this one for each flow, so it's split up.*/
+	for hop < len(req.Flow.Path)-1 && !willFilter(req.Flow.Path[hop].IP, len(req.Keys())) {
+		log.Println(aitf.Hostname(req.Flow.Path[hop].IP), "doesn't take over filters. Skipping it.")
+		if len(req.Batch) > 0 {
+			for _, flow := range req.Flows() {
+				tryNextRouter(flow, hop+1)
+			}
+
+			return true
+		}
+
+		hop++
+	}
+
+	if hop >= len(req.Flow.Path)-1 {
+		for _, key := range req.Keys() {
+			delete(counterConnections, key)
+		}
+
+		return false
+	}
+
+	router := req.Flow.Path[hop].IP
+	log.Println("Asking", aitf.Hostname(router), "to filter", len(req.Keys()), "flows starting with", req.Key(), "- hop", hop)
+
+	cc := &counterConnection{req: req, hop: hop}
+	for _, key := range req.Keys() {
+		counterConnections[key] = cc
+	}
+
+	time.AfterFunc(counterConnectionTimeout, func() {
+		stateMutex.Lock()
+		defer stateMutex.Unlock()
+
+		timeoutCounterConnection(cc)
+	})
+
+	req.Type = filter.CounterConnectionSyn
+	endpoint.Send(req, router)
+	return true
+}
+
+/*
+synAckExpected returns true if req is a SYN-ACK from the router that a
+counter-connection is currently waiting on, about exactly the same flows.  After
+a timeout, this is the next router up the path, so a late answer from the
+router we gave up on doesn't count.
+*/
+func synAckExpected(req filter.Request, from net.IP) bool {
+	for _, key := range req.Keys() {
+		cc := counterConnections[key]
+		if cc == nil || !cc.req.Flow.Path[cc.hop].IP.Equal(from) || !cc.req.SameFlows(&req) {
+			return false
+		}
+	}
+
+	return true
+}
+
+/*
+timeoutCounterConnection gives up on a router that didn't acknowledge a
+counter-connection in time, and moves every flow that's still waiting on it to
+the next router up the path.  Flows that were acknowledged, refused, or revoked
+in the meantime are left alone.  The caller must hold stateMutex.
+*/
+func timeoutCounterConnection(cc *counterConnection) {
+	router := cc.req.Flow.Path[cc.hop].IP
+
+	for _, key := range cc.req.Keys() {
+		if counterConnections[key] != cc {
+			continue
+		}
+
+		log.Println(aitf.Hostname(router), "didn't answer about", key, "within", counterConnectionTimeout)
+		stats.Add("counterConnectionTimeouts", 1)
+
+		/*A late answer from the router we gave up on shouldn't count.  Its filter
+		ACK won't match once the pending ACK is gone, and its SYN-ACK won't match
+		synAckExpected once the counter-connection has moved on to the next
+		router, so it can't set up a new pending ACK either.*/
+		delete(pendingAcks, key)
+		delete(counterConnections, key)
+		tryNextRouter(cc.flow(key), cc.hop+1)
+	}
+}
+
+/*tryNextRouter starts a counter-connection for a flow, or a batch of flows,
+with the router at the given index of the route record, or filters the flows
+here for the long term if there are no more routers to ask.*/
+func tryNextRouter(req filter.Request, hop int) {
+	if !startCounterConnection(req, hop) {
+		for _, flow := range req.Flows() {
+			log.Println("No more routers to ask. Filtering", flow.Key(), "locally.")
+			filters.Install(flow, filter.LongFilterTime, filter.PriorityEscalated)
+		}
+	}
+}
+
+/*
+askAttacker handles a flow whose route record only has this router in it, so the
+victim and the attacker share this router as their gateway, and there's nobody
+to hand the filter off to.  Instead, this router takes the part of the
+attacker's router: the flow is filtered here, and the attacker is asked to stop
+with a filter request of its own.  Once it acknowledges, a shadow filter makes
+sure that it really stopped, just like on any other attacker's router.
+*/
+func askAttacker(req filter.Request, requester net.IP) {
+	if !customers.Contains(req.SrcIP) {
+		log.Println(aitf.Hostname(req.SrcIP), "is not one of our customers, and there's nobody else to ask. Filtering", req.Key(), "locally.")
+		filters.Install(req, filter.LongFilterTime, filter.PriorityEscalated)
+		return
+	}
+
+	log.Println("We're the gateway of", aitf.Hostname(req.SrcIP), "too. Asking it to stop directly.")
+	if err := filters.Install(req, filter.LongFilterTime, filter.PriorityNormal); err != nil {
+		log.Println("Can't filter", req.Key(), "-", err)
+		stats.Add("tableFull", 1)
+	}
+
+	/*The victim is the requester here, so its revocations and renewals are
+	passed on to the attacker.*/
+	requesters[req.Key()] = requester
+
+	req.Type = filter.FilterReq
+	req.Nonce = randomNonce()
+	endpoint.Send(req, req.SrcIP)
+	expectAck(req, req.SrcIP)
+}
+
+/*batchByGateway adds a flow to the batch of other flows behind the same
+attacker's router, or starts a new batch for it if there's no room or the
+router doesn't accept batches.*/
+func batchByGateway(batches [][]filter.Request, req filter.Request) [][]filter.Request {
+	if !acceptsBatches(req.Flow.Path[0].IP) {
+		return append(batches, []filter.Request{req})
+	}
+
+	for i, batch := range batches {
+		if len(batch) < filter.MaxBatchSize && batch[0].Flow.Path[0].IP.Equal(req.Flow.Path[0].IP) {
+			batches[i] = append(batch, req)
+			return batches
+		}
+	}
+
+	return append(batches, []filter.Request{req})
+}
+
+/*
+handleRefusal moves a counter-connection one router up the path after the
+router it was started with refuses to filter the flow or reports an error.  If
+no router is left to ask, the flow is just filtered here.
+
+Each refused flow in a batch is moved on separately.  If a whole batch is
+refused because some of the attackers aren't customers of that router, the
+same router is asked about each flow separately first, since the rest of them
+might be.
+
+A refusal can also come from an attacker that we asked to stop as its gateway,
+which is handled by attackerRefused.
+*/
+func handleRefusal(req filter.Request, from net.IP) {
+	split := len(req.Batch) > 0 && req.Reason == filter.ReasonNotCustomer
+
+	for _, refused := range req.Flows() {
+		key := refused.Key()
+		if pending, ok := pendingAcks[key]; ok && pending.peer.Equal(from) && pending.nonce == refused.Nonce && refused.SrcIP.Equal(from) {
+			attackerRefused(refused)
+			continue
+		}
+
+		cc := counterConnections[key]
+		if cc == nil || !cc.req.Flow.Path[cc.hop].IP.Equal(from) {
+			log.Println("Received an unexpected refusal:", refused)
+			continue
+		}
+
+		log.Println(aitf.Hostname(from), "won't filter", key, "-", req.Reason)
+
+		flow := cc.flow(key)
+		delete(counterConnections, key)
+
+		hop := cc.hop + 1
+		if split {
+			hop = cc.hop
+		}
+
+		tryNextRouter(flow, hop)
+	}
+}
+
+/*
+attackerRefused handles an attacker that won't filter its own flow, for example
+because its filter table is full.  Since we're its gateway, we already filter
+the flow, so we just keep doing so.  The filter's priority is raised, since
+there's nobody left to hand it off to, and it should outlast filters that other
+nodes could take over.  The flow is no longer waiting on an ACK from the
+attacker.  The caller must hold stateMutex.
+*/
+func attackerRefused(req filter.Request) {
+	key := req.Key()
+	log.Println(aitf.Hostname(req.SrcIP), "won't filter", key, "-", req.Reason, "- filtering it here instead.")
+	stats.Add("attackerRefusals", 1)
+
+	delete(pendingAcks, key)
+	if err := filters.Install(req, filter.LongFilterTime, filter.PriorityEscalated); err != nil {
+		log.Println("Can't filter", key, "-", err)
+		stats.Add("tableFull", 1)
+	}
+}
+
+/*
+escalate handles a flow that keeps coming back after a router agreed to filter
+it.  The flow is blocked here for the long term, and the router at the given
+index of the route record is asked to filter it instead.  This is normally the
+router right after the one that didn't comply.
+*/
+func escalate(req filter.Request, hop int) {
+	log.Println("Escalating filter for", req.Key())
+	stats.Add("escalations", 1)
+
+	shadows.Remove(req.Key())
+	filters.Install(req, filter.LongFilterTime, filter.PriorityEscalated)
+
+	if !startCounterConnection(req, hop) {
+		log.Println("No more routers to ask. Filtering", req.Key(), "locally.")
+	}
+}
@@ -0,0 +1,30 @@
+package main
+
+import (
+	"net"
+
+	"github.com/ThomasJClark/cs4404project/aitf"
+	"github.com/ThomasJClark/cs4404project/aitf/filter"
+)
+
+/*customers lists the networks of the hosts that this router is a gateway for.*/
+var customers aitf.PrefixList
+
+/*policyServers lists the hosts that may request filters on behalf of any of our
+customers, such as a dedicated server that detects attacks for a network.*/
+var policyServers aitf.PrefixList
+
+/*
+ownsVictim checks if the host at address "from" may request filters on behalf
+of the victim in req.  The victim may always ask for itself.  Otherwise, only
+a policy server may make requests, and only for victims that are our customers.
+Being in the same customer network isn't enough, or one customer could cut off
+another customer's traffic.
+*/
+func ownsVictim(req filter.Request, from net.IP) bool {
+	if from.Equal(req.DstIP) {
+		return true
+	}
+
+	return policyServers.Contains(from) && customers.Contains(req.DstIP)
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"expvar"
+	"log"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/ThomasJClark/cs4404project/aitf"
+	"github.com/ThomasJClark/cs4404project/aitf/filter"
+)
+
+/*disconnectTime is how long a host is cut off for after it lies about
+complying with a filter request.*/
+var disconnectTime = filter.MaxFilterTime
+
+/*disconnection records why a host was disconnected and until when.*/
+type disconnection struct {
+	Flow  string
+	Until time.Time
+}
+
+/*disconnections holds every host that's currently disconnected.  It's
+published with expvar, so it can be read from the status server along with the
+other statistics.*/
+var disconnections = make(map[string]disconnection)
+var disconnectionsMutex sync.Mutex
+
+func init() {
+	expvar.Publish("disconnections", expvar.Func(func() interface{} {
+		disconnectionsMutex.Lock()
+		defer disconnectionsMutex.Unlock()
+
+		active := make(map[string]disconnection)
+		for host, d := range disconnections {
+			if time.Now().Before(d.Until) {
+				active[host] = d
+			}
+		}
+
+		return active
+	}))
+}
+
+/*
+disconnect blocks all traffic from a host that we're the gateway of, because it
+acknowledged a filter request for the given flow and kept sending anyway.  This
+is the penalty in AITF for hosts that don't comply.
+*/
+func disconnect(host net.IP, key filter.FlowKey) {
+	log.Println("Disconnecting", aitf.Hostname(host), "for", disconnectTime, "for not filtering", key)
+	stats.Add("disconnections", 1)
+
+	filters.Install(filter.Disconnection(host), disconnectTime, filter.PriorityEscalated)
+
+	disconnectionsMutex.Lock()
+	disconnections[host.String()] = disconnection{Flow: key.String(), Until: time.Now().Add(disconnectTime)}
+	disconnectionsMutex.Unlock()
+}
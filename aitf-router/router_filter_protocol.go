@@ -1,10 +1,9 @@
 package main
 
 import (
-	"bytes"
 	"log"
-	"math/rand"
 	"net"
+	"sync"
 
 	"github.com/ThomasJClark/cs4404project/aitf"
 	"github.com/ThomasJClark/cs4404project/aitf/filter"
@@ -18,8 +17,16 @@ const (
 	lie
 )
 
-var handshakes map[uint64](*filter.Request)
-var shadowFilters []filter.Request
+var endpoint *filter.Endpoint
+var filters = filter.NewTable(true)
+
+/*requesters remembers which router asked us to take over each filter that we've
+installed as the attacker's router.*/
+var requesters = make(map[filter.FlowKey]net.IP)
+
+/*stateMutex protects the state of the filter protocol, since it's used both by
+the control socket listener and when watching forwarded traffic.*/
+var stateMutex sync.Mutex
 
 /*
 listenForFilterRequest waits for a filter request from a client to come.  Then,
@@ -27,122 +34,339 @@ it verifies the authenticity of the request and takes the appropriate action
 based on the AITF filter request protocol.
 */
 func listenForFilterRequest(mode complianceMode) {
-	if handshakes == nil {
-		handshakes = make(map[uint64](*filter.Request))
-	}
+	for {
+		/*Read a request from the control socket*/
+		req, addr, err := endpoint.Receive()
+		if err == filter.ErrStale {
+			log.Println("Received a", err, "from", aitf.Hostname(addr.IP))
+			stats.Add("replayedMessages", 1)
+			continue
+		} else if err != nil {
+			log.Println(err)
+			continue
+		}
 
-	/*Open up a UDP server on the filter request port and handle any messages
-	that arrive.*/
-	serverAddr, err := net.ResolveUDPAddr("udp", ":54321")
-	if err != nil {
-		log.Fatal(err)
-	}
+		/*Throw the request away if it is not authentic.  Hellos aren't about any
+		flow, so they don't have a route record to check.*/
+		hello := req.Type == filter.Hello || req.Type == filter.HelloAck
+		if !hello && !req.Authentic() {
+			log.Println("Received a forged filter request!")
+			continue
+		}
+
+		/*Throw it away if it isn't signed by a router that should be signing its
+		messages.*/
+		if !signedByPeer(req, addr.IP) {
+			log.Println("Received a", req.Type, "with a bad signature from", aitf.Hostname(addr.IP))
+			stats.Add("badSignatures", 1)
+			continue
+		}
 
-	serverConn, err := net.ListenUDP("udp", serverAddr)
-	if err != nil {
-		log.Fatal(err)
+		/*Only check signed messages for replays.  An unsigned message's ID can be
+		changed by anyone, so remembering it wouldn't stop a replay, and anyone
+		could fill up the replay cache with them.*/
+		if keys.Has(addr.IP) {
+			if err := endpoint.CheckReplay(&req); err != nil {
+				log.Println("Received a", err, "from", aitf.Hostname(addr.IP))
+				stats.Add("replayedMessages", 1)
+				continue
+			}
+		}
+
+		stateMutex.Lock()
+		handleRequest(mode, req, addr)
+		stateMutex.Unlock()
 	}
+}
 
-	defer serverConn.Close()
+/*
+handleRequest takes the appropriate action for a single authentic message
+based on the AITF filter request protocol.  The caller must hold stateMutex.
+*/
+func handleRequest(mode complianceMode, req filter.Request, addr *net.UDPAddr) {
+	log.Println("Got", req.Type, "from", aitf.Hostname(addr.IP))
 
-	buf := make([]byte, 5000)
-	for {
-		n, addr, _ := serverConn.ReadFromUDP(buf)
+	switch req.Type {
+	case filter.FilterReq:
+		/*A victim asks again with a hint if the attack kept going after its
+		request was acknowledged.  The hint isn't passed along to anyone else.*/
+		persists := req.Reason == filter.ReasonAttackPersists
+		req.Reason = filter.ReasonNone
 
-		/*Read a request from the UDP connection*/
-		var req filter.Request
-		_, err := req.ReadFrom(bytes.NewBuffer(buf[:n]))
-		if err != nil {
-			log.Println(err)
-			continue
+		/*A victim under a distributed attack can ask for many flows at once in a
+		batch, but every flow is checked the same way as a separate request.*/
+		flows := req.Flows()
+
+		/*Hosts can only ask for filters to protect themselves. Otherwise, one
+		customer could cut off another customer's traffic.*/
+		for _, flow := range flows {
+			if !ownsVictim(flow, addr.IP) {
+				log.Println(aitf.Hostname(addr.IP), "requested a filter for a victim it doesn't own:", aitf.Hostname(flow.DstIP))
+				stats.Add("unauthorizedRequests", 1)
+				reject(req, addr, filter.FilterRefused, filter.ReasonNotOwner)
+				return
+			}
 		}
 
-		/*Throw the request away if it is not authentic.*/
-		if !req.Authentic() {
-			log.Println("Received a forged filter request!")
-			continue
+		/*Every filter request costs a firewall rule and a counter-connection, so
+		customers can only make so many of them.*/
+		if !allowRequest(addr.IP, len(flows)) {
+			log.Println(aitf.Hostname(addr.IP), "is sending too many filter requests.")
+			stats.Add("rateLimitedRequests", 1)
+			reject(req, addr, filter.FilterRefused, filter.ReasonRateLimited)
+			return
 		}
 
-		log.Println("Got", req.Type, "from", aitf.Hostname(addr.IP))
-
-		switch req.Type {
-		case filter.FilterReq:
-			/*When we receive a filter request, install a temporary filter and begin
-			a counter-connection with the attacker's router. Also let the victim know
-			that the attack should have stopped with a filter ACK. The filter is
-			installed for the full filter time instead of the temporary time, but is
-			automatically removed when we get a filter ACK.*/
-			filter.InstallFilter(req, filter.LongFilterTime, true)
-			req.Type = filter.FilterAck
-			req.Send(addr.IP)
-
-			/*If we've blocked this filter before and it's still happening, escalate
-			the filter and just block it here.*/
-			for _, req2 := range shadowFilters {
-				if req2.SrcIP.Equal(req.SrcIP) && req2.DstIP.Equal(req.DstIP) {
-					log.Println("Escalating request.")
+		/*When we receive a filter request, install a temporary filter and begin
+		a counter-connection with the attacker's router. Also let the victim know
+		that the attack should have stopped with a filter ACK. The temporary
+		filter is removed when the attacker's router confirms that it took over
+		with a filter ACK. If that doesn't happen in time, we keep filtering the
+		flow here for the full filter time.*/
+		for _, flow := range flows {
+			if err := filters.InstallTemporary(flow, filter.TemporaryFilterTime, filter.LongFilterTime); err != nil {
+				/*Without room for a filter here, the victim is relying entirely on
+				a router further up the path, so still start the counter-connection.*/
+				log.Println("Can't filter", flow.Key(), "locally:", err)
+				stats.Add("tableFull", 1)
+			}
+		}
+
+		req.Type = filter.FilterAck
+		endpoint.SendTo(req, addr)
+
+		/*If another router agreed to filter a flow and it's still happening,
+		escalate the filter instead of asking the same router again.  The rest of
+		the flows are grouped by the attacker's router, so there's only one
+		counter-connection with each router.*/
+		var batches [][]filter.Request
+		for _, flow := range flows {
+			if shadow, ok := shadows.Get(flow.Key()); ok {
+				escalate(flow, shadow.hop+1)
+				continue
+			}
+
+			if len(flow.Flow.Path) <= 1 {
+				askAttacker(flow, addr.IP)
+				continue
+			}
+
+			/*If the victim says the attack didn't stop but there's no shadow filter
+			to confirm it, block the flow here for the long term anyway, and ask the
+			router after the attacker's router, since that one didn't stop it.*/
+			if persists {
+				log.Println(aitf.Hostname(addr.IP), "says the attack from", aitf.Hostname(flow.SrcIP), "didn't stop.")
+				stats.Add("persistentAttacks", 1)
+				filters.Install(flow, filter.LongFilterTime, filter.PriorityEscalated)
+				tryNextRouter(flow, 1)
+				continue
+			}
+
+			batches = batchByGateway(batches, flow)
+		}
+
+		for _, batch := range batches {
+			batchReq, err := filter.NewBatch(batch)
+			if err != nil {
+				log.Println(err)
+				continue
+			}
+
+			tryNextRouter(batchReq, 0)
+		}
+
+	case filter.CounterConnectionSyn:
+		if mode == comply || mode == lie {
+			/*Only filter traffic from our own customers. Otherwise, a malicious
+			router could get us to block arbitrary traffic or send filter requests
+			to random hosts. Refusing explicitly lets the other router try someone
+			further up the path.*/
+			flows := req.Flows()
+			for _, flow := range flows {
+				if !customers.Contains(flow.SrcIP) {
+					log.Println(aitf.Hostname(flow.SrcIP), "is not one of our customers. Refusing.")
+					stats.Add("refusedCounterConnections", 1)
+					reject(req, addr, filter.FilterRefused, filter.ReasonNotCustomer)
 					return
 				}
 			}
 
-			req.Type = filter.CounterConnectionSyn
-			req.Send(req.Flow.Path[0].IP)
-
-		case filter.CounterConnectionSyn:
-			if mode == comply || mode == lie {
-				/*When we get a counter-connection SYN, continue the three-way handshake
-				with a SYN-ACK. We don't install a filter until we get an ACK back with
-				the right nonce.*/
-				req.Type = filter.CounterConnectionSynAck
-				req.Nonce = uint64(rand.Int63())
-				handshakes[req.Nonce] = &req
-				req.Send(addr.IP)
-			}
-
-		case filter.CounterConnectionSynAck:
-			if mode == comply || mode == lie {
-				/*When we receive a response to a counter-connection, complete the
-				three-way handshake.*/
-				req.Type = filter.CounterConnectionAck
-				req.Send(addr.IP)
-			}
-
-		case filter.CounterConnectionAck:
-			if mode == comply || mode == lie {
-				/*When we receive a counter-connection ACK, make sure we're actually
-				waiting for a response to that handshake, then install a temporary
-				filter.*/
-				originalReq := handshakes[req.Nonce]
-				if originalReq == nil {
-					log.Println("Received a forged three-way handshake:", req)
+			/*One router can't make us install an unlimited number of filters.*/
+			if !peerLimits.AllowN(addr.IP.String(), len(flows)) {
+				log.Println(aitf.Hostname(addr.IP), "is starting too many counter-connections. Refusing.")
+				stats.Add("rateLimitedCounterConnections", 1)
+				reject(req, addr, filter.FilterRefused, filter.ReasonRateLimited)
+				return
+			}
+
+			if overQuota(addr.IP, len(flows)) {
+				log.Println(aitf.Hostname(addr.IP), "has too many active filters. Refusing.")
+				stats.Add("overQuotaCounterConnections", 1)
+				reject(req, addr, filter.FilterRefused, filter.ReasonQuotaExceeded)
+				return
+			}
+
+			/*When we get a counter-connection SYN, continue the three-way handshake
+			with a SYN-ACK. We don't install a filter until we get an ACK back with
+			the right nonce.*/
+			nonce, ok := handshakes.Begin(req, addr.IP)
+			if !ok {
+				log.Println("Too many counter-connections in progress. Refusing.")
+				reject(req, addr, filter.FilterRefused, filter.ReasonNoCapacity)
+				return
+			}
+
+			req.Type = filter.CounterConnectionSynAck
+			req.Nonce = nonce
+			endpoint.SendTo(req, addr)
+		}
+
+	case filter.CounterConnectionSynAck:
+		if mode == comply || mode == lie {
+			/*Only answer a SYN-ACK from the router that we're asking to filter
+			these flows.  Otherwise, anyone could make up a nonce and then use it to
+			forge a filter ACK.*/
+			if !synAckExpected(req, addr.IP) {
+				log.Println("Received a SYN-ACK for a counter-connection we didn't start from", aitf.Hostname(addr.IP))
+				stats.Add("forgedAcks", 1)
+				return
+			}
+
+			/*When we receive a response to a counter-connection, complete the
+			three-way handshake.*/
+			req.Type = filter.CounterConnectionAck
+			endpoint.SendTo(req, addr)
+
+			/*The attacker's router should send a filter ACK once it's taken over
+			the filter.  Nobody else may lift our filter on its behalf.*/
+			expectAck(req, addr.IP)
+		}
+
+	case filter.CounterConnectionAck:
+		if mode == comply || mode == lie {
+			/*When we receive a counter-connection ACK, make sure we're actually
+			waiting for a response to that handshake, then install a temporary
+			filter.*/
+			originalReq := handshakes.Complete(req, addr.IP)
+			if originalReq == nil {
+				log.Println("Received a forged or expired three-way handshake:", req)
+				reject(req, addr, filter.FilterError, filter.ReasonUnknownHandshake)
+				return
+			}
+
+			/*Act on the request that the handshake was started for, not whatever
+			else the ACK says.*/
+			req = *originalReq
+		}
+
+		if mode == comply {
+			/*Several handshakes could have been started before the quota ran out,
+			so check it again before actually installing anything.*/
+			flows := req.Flows()
+			if overQuota(addr.IP, len(flows)) {
+				log.Println(aitf.Hostname(addr.IP), "has too many active filters. Refusing.")
+				stats.Add("overQuotaCounterConnections", 1)
+				reject(req, addr, filter.FilterRefused, filter.ReasonQuotaExceeded)
+				return
+			}
+
+			var accepted []filter.Request
+			for _, flow := range flows {
+				/*The filter is installed for the full filter time instead of the
+				temporary time, but is automatically removed when we get a filter
+				ACK.  If there's no room for it, refuse that flow so the victim's
+				router asks the next router up the path instead.*/
+				if err := filters.Install(flow, filter.LongFilterTime, filter.PriorityNormal); err != nil {
+					log.Println("Can't filter", flow.Key(), "-", err)
+					stats.Add("tableFull", 1)
+					reject(flow, addr, filter.FilterRefused, filter.ReasonNoCapacity)
 					continue
-				} else {
-					delete(handshakes, req.Nonce)
 				}
+
+				/*The attacker should be informed of its wrongdoing.*/
+				requesters[flow.Key()] = addr.IP
+
+				flow.Type = filter.FilterReq
+				endpoint.Send(flow, flow.SrcIP)
+				expectAck(flow, flow.SrcIP)
+				accepted = append(accepted, flow)
 			}
 
-			if mode == comply {
-				/*The filter is installed for the full filter time instead of the
-				temporary time, but is automatically removed when we get a filter ACK.*/
-				filter.InstallFilter(req, filter.LongFilterTime, true)
+			/*The victim's router should be informed that this router is complying
+			with the request, with one ACK for every flow that's now filtered.*/
+			if len(accepted) > 0 {
+				ack, err := filter.NewBatch(accepted)
+				if err != nil {
+					log.Println(err)
+					return
+				}
 
-				/*The attacker should be informed of its wrongdoing, and the victim's
-				router should be informed that this router is complying with the
-				request.*/
-				req.Type = filter.FilterReq
-				req.Send(req.SrcIP)
-				req.Type = filter.FilterAck
-				req.Send(addr.IP)
+				ack.Type = filter.FilterAck
+				endpoint.SendTo(ack, addr)
+			}
+		}
+
+	case filter.FilterAck:
+		/*Only accept an acknowledgement from the node that we're waiting on for
+		this flow, with the nonce from the handshake.  Otherwise, anyone with a
+		valid route record could lift the filter.  Each flow in a batched ACK is
+		checked separately.*/
+		for _, flow := range req.Flows() {
+			if !checkAck(flow, addr.IP) {
+				log.Println("Received a forged filter acknowledgement from", aitf.Hostname(addr.IP))
+				stats.Add("forgedAcks", 1)
+				continue
 			}
 
-		case filter.FilterAck:
 			if mode == comply {
-				/*When we get acknowledgement of compliance with a filter, we can remove
-				our temporary filter. Nobody lies on the internet.*/
-				filter.UninstallFilter(req, true)
+				/*When we get acknowledgement of compliance with a filter, we can
+				remove our temporary filter. A shadow filter makes sure the flow
+				actually stopped, since the other node might be lying.  Filters that
+				were escalated because another node already failed to stop the flow
+				are kept for their full time anyway.*/
+				if p, ok := filters.Priority(flow.Key()); ok && p < filter.PriorityEscalated {
+					filters.Remove(flow.Key())
+				}
 
-				shadowFilters = append(shadowFilters, req)
+				shadow := shadowFilter{req: flow, peer: addr.IP}
+				if cc := counterConnections[flow.Key()]; cc != nil {
+					shadow.hop = cc.hop
+					delete(counterConnections, flow.Key())
+				}
+
+				shadows.Add(shadow)
 			}
 		}
+
+	case filter.FilterRevoke:
+		for _, flow := range req.Flows() {
+			handleRevoke(flow, addr)
+		}
+
+	case filter.FilterRenew:
+		for _, flow := range req.Flows() {
+			handleRenew(flow, addr)
+		}
+
+	case filter.Hello, filter.HelloAck:
+		handleHello(req, addr)
+
+	case filter.FilterRefused, filter.FilterError:
+		/*A router we asked to filter won't, so ask the next one up the path
+		instead of waiting for it.  If it's an attacker that won't, keep filtering
+		it here.*/
+		handleRefusal(req, addr.IP)
+
+	default:
+		log.Println("Unexpected filter request:", req)
+		reject(req, addr, filter.FilterError, filter.ReasonUnexpectedMessage)
 	}
 }
+
+/*reject replies to a message with a negative response of the given type,
+explaining why with the given reason.*/
+func reject(req filter.Request, to *net.UDPAddr, t filter.MessageType, reason filter.Reason) {
+	req.Type = t
+	req.Reason = reason
+	endpoint.SendTo(req, to)
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"log"
+	"net"
+
+	"github.com/ThomasJClark/cs4404project/aitf"
+	"github.com/ThomasJClark/cs4404project/aitf/filter"
+)
+
+/*
+nextFilterNode checks that a revocation or renewal of a filter came from a node
+that's allowed to send one, and returns the next node filtering the flow, which
+the message should be passed on to.
+
+On the attacker's router, the message must come from the router that asked us
+to filter the flow, and it's passed on to the attacker.
+
+On the victim's router, the message must come from the victim, just like the
+original request.  It's passed on to the router that took over the filter, or
+the one that we're still trying to hand it off to.  If there's no such router,
+next is nil.
+
+ok is false if the sender isn't allowed to change the filter.
+*/
+func nextFilterNode(req filter.Request, from net.IP) (next net.IP, ok bool) {
+	key := req.Key()
+
+	if requester := requesters[key]; requester != nil && requester.Equal(from) {
+		return req.SrcIP, true
+	}
+
+	if ownsVictim(req, from) {
+		if cc := counterConnections[key]; cc != nil {
+			return cc.req.Flow.Path[cc.hop].IP, true
+		} else if shadow, ok := shadows.Get(key); ok {
+			return shadow.peer, true
+		}
+
+		return nil, true
+	}
+
+	return nil, false
+}
+
+/*
+handleRevoke removes the filter on a flow when its victim withdraws the filter
+request, and passes the revocation along to the next node that is filtering it.
+*/
+func handleRevoke(req filter.Request, addr *net.UDPAddr) {
+	key := req.Key()
+
+	next, ok := nextFilterNode(req, addr.IP)
+	if !ok {
+		log.Println(aitf.Hostname(addr.IP), "tried to revoke a filter it doesn't own:", key)
+		stats.Add("forgedRevokes", 1)
+		reject(req, addr, filter.FilterRefused, filter.ReasonNotOwner)
+		return
+	}
+
+	if next != nil {
+		endpoint.Send(req, next)
+	}
+
+	log.Println("Revoking filter", key)
+	filters.Remove(key)
+
+	delete(counterConnections, key)
+	delete(pendingAcks, key)
+	shadows.Remove(key)
+	delete(requesters, key)
+}
+
+/*
+handleRenew extends the lifetime of the filter on a flow when its victim asks,
+and passes the renewal along to the next node that is filtering it.  Every node
+keeps count of the renewals itself, and blocks the flow for longer each time.
+*/
+func handleRenew(req filter.Request, addr *net.UDPAddr) {
+	key := req.Key()
+
+	next, ok := nextFilterNode(req, addr.IP)
+	if !ok {
+		log.Println(aitf.Hostname(addr.IP), "tried to renew a filter it doesn't own:", key)
+		stats.Add("forgedRenewals", 1)
+		reject(req, addr, filter.FilterRefused, filter.ReasonNotOwner)
+		return
+	}
+
+	if next != nil {
+		endpoint.Send(req, next)
+	}
+
+	filters.Renew(key)
+	shadows.Renew(key)
+}
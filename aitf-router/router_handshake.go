@@ -0,0 +1,186 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"log"
+	"net"
+	"time"
+
+	"github.com/ThomasJClark/cs4404project/aitf/filter"
+)
+
+/*handshakeTimeout is how long a counter-connection handshake can wait for its
+ACK.  The victim's router only blocks the flow temporarily while the handshake
+runs, so there's no point waiting for longer than that.*/
+const handshakeTimeout = filter.TemporaryFilterTime
+
+/*
+handshaker is used by the attacker's router to run the three-way handshake of a
+counter-connection, which makes sure that the router asking for a filter is
+really on the path to the victim.
+*/
+type handshaker interface {
+	/*Begin is called when a SYN arrives from peer, and returns the nonce to send
+	back in the SYN-ACK.  If ok is false, the handshake should be refused.*/
+	Begin(req filter.Request, peer net.IP) (nonce uint64, ok bool)
+
+	/*Complete is called when an ACK arrives from peer, and returns the request
+	that the handshake was started for, which should be acted on instead of the
+	ACK itself.  If the ACK doesn't match a handshake that's in progress for
+	exactly the same flow, nil is returned.*/
+	Complete(req filter.Request, peer net.IP) *filter.Request
+}
+
+/*handshakes is the handshaker chosen on the command line.*/
+var handshakes handshaker
+
+/*pendingHandshake is a counter-connection that we've sent a SYN-ACK for.*/
+type pendingHandshake struct {
+	req      filter.Request
+	peer     net.IP
+	deadline time.Time
+}
+
+/*
+statefulHandshaker remembers every counter-connection handshake that's waiting
+for an ACK, indexed by nonce.  Since anyone can send a SYN, there's a maximum
+number of handshakes.  Once it's reached and none of the handshakes have
+expired, new handshakes are refused until there's room again.  Handshakes that
+are already in progress are never pushed out, so a flood of SYNs can't break
+them.
+
+It's only used while holding stateMutex.
+*/
+type statefulHandshaker struct {
+	max     int
+	pending map[uint64]*pendingHandshake
+}
+
+func newStatefulHandshaker(max int) *statefulHandshaker {
+	return &statefulHandshaker{max: max, pending: make(map[uint64]*pendingHandshake)}
+}
+
+func (h *statefulHandshaker) Begin(req filter.Request, peer net.IP) (uint64, bool) {
+	if len(h.pending) >= h.max {
+		h.expire()
+	}
+
+	if len(h.pending) >= h.max {
+		stats.Add("droppedHandshakes", 1)
+		return 0, false
+	}
+
+	nonce := randomNonce()
+	for h.pending[nonce] != nil {
+		nonce = randomNonce()
+	}
+
+	req.Nonce = nonce
+	h.pending[nonce] = &pendingHandshake{req: req, peer: peer, deadline: time.Now().Add(handshakeTimeout)}
+	return nonce, true
+}
+
+func (h *statefulHandshaker) Complete(req filter.Request, peer net.IP) *filter.Request {
+	pending := h.pending[req.Nonce]
+	if pending == nil || !pending.peer.Equal(peer) || !pending.req.SameFlows(&req) {
+		return nil
+	}
+
+	delete(h.pending, req.Nonce)
+	if time.Now().After(pending.deadline) {
+		return nil
+	}
+
+	return &pending.req
+}
+
+/*randomNonce returns a nonce that can't be guessed by anyone watching previous
+handshakes.*/
+func randomNonce() uint64 {
+	var nonce uint64
+	if err := binary.Read(rand.Reader, binary.BigEndian, &nonce); err != nil {
+		log.Fatal(err)
+	}
+
+	return nonce
+}
+
+/*expire forgets every handshake that's past its deadline.*/
+func (h *statefulHandshaker) expire() {
+	now := time.Now()
+	for nonce, pending := range h.pending {
+		if now.After(pending.deadline) {
+			log.Println("Counter-connection for", pending.req.Key(), "timed out.")
+			delete(h.pending, nonce)
+		}
+	}
+}
+
+/*expirePeriodically sweeps expired handshakes out of the table, so they don't
+take up memory until the table fills up.*/
+func (h *statefulHandshaker) expirePeriodically() {
+	for _ = range time.Tick(handshakeTimeout) {
+		stateMutex.Lock()
+		h.expire()
+		stateMutex.Unlock()
+	}
+}
+
+/*
+cookieHandshaker runs counter-connection handshakes without keeping any state,
+like TCP SYN cookies.  The nonce in the SYN-ACK is a keyed hash of the flow, the
+router that sent the SYN, and the current time, so the ACK can be checked just
+by computing the hash again.  This way, a flood of SYNs doesn't use up any
+memory.  For a batch, the hash covers every flow in it.
+*/
+type cookieHandshaker struct {
+	key []byte
+}
+
+func newCookieHandshaker() *cookieHandshaker {
+	key := make([]byte, sha256.Size)
+	if _, err := rand.Read(key); err != nil {
+		log.Fatal(err)
+	}
+
+	return &cookieHandshaker{key: key}
+}
+
+/*cookie computes the nonce for a handshake with peer about the flows in req,
+during the given interval of time.*/
+func (h *cookieHandshaker) cookie(req filter.Request, peer net.IP, interval int64) uint64 {
+	mac := hmac.New(sha256.New, h.key)
+	for _, key := range req.Keys() {
+		mac.Write(key.SrcIP[:])
+		mac.Write(key.DstIP[:])
+	}
+
+	mac.Write(peer.To4())
+	binary.Write(mac, binary.BigEndian, interval)
+
+	return binary.BigEndian.Uint64(mac.Sum(nil))
+}
+
+/*interval returns the number of the current handshakeTimeout-long interval.*/
+func (h *cookieHandshaker) interval() int64 {
+	return time.Now().UnixNano() / int64(handshakeTimeout)
+}
+
+func (h *cookieHandshaker) Begin(req filter.Request, peer net.IP) (uint64, bool) {
+	return h.cookie(req, peer, h.interval()), true
+}
+
+/*Complete accepts cookies from the current and the previous interval, so every
+handshake gets at least handshakeTimeout to finish.  Since the cookie covers
+the flows, the ACK can only be for the same flows as the SYN.*/
+func (h *cookieHandshaker) Complete(req filter.Request, peer net.IP) *filter.Request {
+	interval := h.interval()
+	if req.Nonce == h.cookie(req, peer, interval) || req.Nonce == h.cookie(req, peer, interval-1) {
+		return &req
+	}
+
+	return nil
+}
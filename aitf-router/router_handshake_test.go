@@ -0,0 +1,178 @@
+package main
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/ThomasJClark/cs4404project/aitf/filter"
+)
+
+func testFlow(src string) filter.Request {
+	return filter.Request{SrcIP: net.ParseIP(src), DstIP: net.ParseIP("10.4.31.2")}
+}
+
+func TestStatefulHandshakerCap(t *testing.T) {
+	peer := net.ParseIP("10.4.31.3")
+	h := newStatefulHandshaker(2)
+
+	tests := []struct {
+		name   string
+		src    string
+		expire bool /*Whether every pending handshake expires first*/
+		ok     bool
+	}{
+		{"first", "10.4.32.4", false, true},
+		{"second", "10.4.32.5", false, true},
+		{"full", "10.4.32.6", false, false},
+		{"full after expiry", "10.4.32.6", true, true},
+	}
+
+	for _, test := range tests {
+		if test.expire {
+			for _, pending := range h.pending {
+				pending.deadline = time.Now().Add(-time.Millisecond)
+			}
+		}
+
+		if _, ok := h.Begin(testFlow(test.src), peer); ok != test.ok {
+			t.Errorf("%s: Begin() = %v, want %v", test.name, ok, test.ok)
+		}
+
+		if len(h.pending) > h.max {
+			t.Errorf("%s: %d handshakes pending, want at most %d", test.name, len(h.pending), h.max)
+		}
+	}
+}
+
+func TestStatefulHandshakerExpiry(t *testing.T) {
+	peer := net.ParseIP("10.4.31.3")
+	req := testFlow("10.4.32.4")
+
+	tests := []struct {
+		name     string
+		deadline time.Duration
+		ok       bool
+	}{
+		{"in time", handshakeTimeout, true},
+		{"too late", -time.Millisecond, false},
+	}
+
+	for _, test := range tests {
+		h := newStatefulHandshaker(10)
+		nonce, _ := h.Begin(req, peer)
+		h.pending[nonce].deadline = time.Now().Add(test.deadline)
+
+		ack := req
+		ack.Nonce = nonce
+		if ok := h.Complete(ack, peer) != nil; ok != test.ok {
+			t.Errorf("%s: Complete() = %v, want %v", test.name, ok, test.ok)
+		}
+
+		if len(h.pending) != 0 {
+			t.Errorf("%s: handshake still pending after its ACK", test.name)
+		}
+	}
+
+	h := newStatefulHandshaker(10)
+	h.Begin(req, peer)
+	for _, pending := range h.pending {
+		pending.deadline = time.Now().Add(-time.Millisecond)
+	}
+
+	h.expire()
+	if len(h.pending) != 0 {
+		t.Errorf("%d expired handshakes weren't swept", len(h.pending))
+	}
+}
+
+func TestCookieHandshaker(t *testing.T) {
+	peer := net.ParseIP("10.4.31.3")
+	req := testFlow("10.4.32.4")
+	h := newCookieHandshaker()
+
+	batch, err := filter.NewBatch([]filter.Request{req, testFlow("10.4.32.5")})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	nonce, ok := h.Begin(req, peer)
+	if !ok {
+		t.Fatal("Begin() refused a handshake")
+	}
+
+	tests := []struct {
+		name  string
+		ack   filter.Request
+		nonce uint64
+		peer  net.IP
+		ok    bool
+	}{
+		{"valid", req, nonce, peer, true},
+		{"previous interval", req, h.cookie(req, peer, h.interval()-1), peer, true},
+		{"expired", req, h.cookie(req, peer, h.interval()-2), peer, false},
+		{"wrong nonce", req, nonce + 1, peer, false},
+		{"wrong peer", req, nonce, net.ParseIP("10.4.31.9"), false},
+		{"wrong flow", testFlow("10.4.32.9"), nonce, peer, false},
+		{"extra flows", batch, nonce, peer, false},
+	}
+
+	for _, test := range tests {
+		test.ack.Nonce = test.nonce
+		if ok := h.Complete(test.ack, test.peer) != nil; ok != test.ok {
+			t.Errorf("%s: Complete() = %v, want %v", test.name, ok, test.ok)
+		}
+	}
+}
+
+func TestStatefulHandshakerComplete(t *testing.T) {
+	peer := net.ParseIP("10.4.31.3")
+	req := testFlow("10.4.32.4")
+	req.Flow.Protocol = 6
+
+	batch, err := filter.NewBatch([]filter.Request{req, testFlow("10.4.32.5")})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name string
+		ack  filter.Request
+		peer net.IP
+		ok   bool
+	}{
+		{"valid", testFlow("10.4.32.4"), peer, true},
+		{"wrong peer", req, net.ParseIP("10.4.31.9"), false},
+		{"wrong flow", testFlow("10.4.32.9"), peer, false},
+		{"extra flows", batch, peer, false},
+	}
+
+	for _, test := range tests {
+		h := newStatefulHandshaker(10)
+		nonce, _ := h.Begin(req, peer)
+
+		test.ack.Nonce = nonce
+		got := h.Complete(test.ack, test.peer)
+		if (got != nil) != test.ok {
+			t.Errorf("%s: Complete() = %v, want ok %v", test.name, got, test.ok)
+			continue
+		}
+
+		if got == nil {
+			if len(h.pending) != 1 {
+				t.Errorf("%s: a bad ACK cancelled the handshake", test.name)
+			}
+
+			continue
+		}
+
+		/*The request from the SYN is what's acted on, not whatever the ACK says.*/
+		if got.Flow.Protocol != req.Flow.Protocol || got.Nonce != nonce {
+			t.Errorf("%s: Complete() returned %+v, want the request from the SYN", test.name, got)
+		}
+
+		if h.Complete(test.ack, test.peer) != nil {
+			t.Errorf("%s: the same ACK completed the handshake twice", test.name)
+		}
+	}
+}
@@ -0,0 +1,44 @@
+package main
+
+import (
+	"net"
+
+	"github.com/ThomasJClark/cs4404project/aitf/filter"
+)
+
+/*keys holds the keys shared with peer routers.  Messages to and from them are
+signed, and messages from them with bad signatures are thrown away.*/
+var keys = filter.NewKeyRing()
+
+/*requireSignatures makes the router throw away counter-connection messages from
+routers that it doesn't have a key for.*/
+var requireSignatures bool
+
+/*
+signedByPeer checks the signature on a message from another node.  Messages
+from peers on the key ring must have a valid signature.  Other nodes, such as
+hosts, can't sign their messages, so they're accepted unless the message is
+one that only routers send and signatures are required.
+*/
+func signedByPeer(req filter.Request, from net.IP) bool {
+	switch keys.Verify(&req, from) {
+	case nil:
+		return true
+	case filter.ErrNoKey:
+		return !requireSignatures || !betweenRouters(req.Type)
+	}
+
+	return false
+}
+
+/*betweenRouters returns true for the types of messages that are only ever sent
+from one router to another.*/
+func betweenRouters(t filter.MessageType) bool {
+	switch t {
+	case filter.CounterConnectionSyn, filter.CounterConnectionSynAck, filter.CounterConnectionAck,
+		filter.Hello, filter.HelloAck:
+		return true
+	}
+
+	return false
+}
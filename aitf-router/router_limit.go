@@ -0,0 +1,110 @@
+package main
+
+import (
+	"net"
+	"time"
+
+	"github.com/ThomasJClark/cs4404project/aitf/filter"
+)
+
+/*tokenBucket holds the tokens available to one sender.*/
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+/*
+rateLimiter limits how often each sender can do something, using a token bucket
+for each sender.  Each bucket fills up at a fixed rate per second up to a
+maximum burst, and every request takes a token.  A rate of 0 means there's no
+limit.
+
+Buckets that have filled back up are the same as new ones, so they're thrown
+away once there are a lot of them.
+
+A rateLimiter is only used while holding stateMutex.
+*/
+type rateLimiter struct {
+	rate    float64
+	burst   float64
+	buckets map[string]*tokenBucket
+}
+
+/*maxIdleBuckets is how many buckets a rateLimiter keeps before throwing away
+the full ones.*/
+const maxIdleBuckets = 4096
+
+func newRateLimiter(rate float64, burst int) *rateLimiter {
+	return &rateLimiter{rate: rate, burst: float64(burst), buckets: make(map[string]*tokenBucket)}
+}
+
+/*Allow takes a token from the sender's bucket, and returns false if there
+weren't any left.*/
+func (l *rateLimiter) Allow(sender string) bool {
+	return l.AllowN(sender, 1)
+}
+
+/*AllowN takes n tokens from the sender's bucket at once, for a batch of
+requests.  If there aren't enough left, none are taken and false is returned.*/
+func (l *rateLimiter) AllowN(sender string, n int) bool {
+	if l.rate == 0 {
+		return true
+	}
+
+	now := time.Now()
+
+	if len(l.buckets) >= maxIdleBuckets {
+		for key, b := range l.buckets {
+			if l.refill(b, now) >= l.burst {
+				delete(l.buckets, key)
+			}
+		}
+	}
+
+	b := l.buckets[sender]
+	if b == nil {
+		b = &tokenBucket{tokens: l.burst, last: now}
+		l.buckets[sender] = b
+	}
+
+	if l.refill(b, now) < float64(n) {
+		return false
+	}
+
+	b.tokens -= float64(n)
+	return true
+}
+
+/*refill adds the tokens that a bucket has earned since it was last used, and
+returns how many it has.*/
+func (l *rateLimiter) refill(b *tokenBucket, now time.Time) float64 {
+	b.tokens += l.rate * now.Sub(b.last).Seconds()
+	if b.tokens > l.burst {
+		b.tokens = l.burst
+	}
+
+	b.last = now
+	return b.tokens
+}
+
+/*hostLimits and prefixLimits limit how many filter requests each customer
+host, and each customer network, can make.  A batch takes a token for each of
+its flows all at once, so the bursts have to fit a full batch, or it would
+always be refused.*/
+var hostLimits = newRateLimiter(10, filter.MaxBatchSize)
+var prefixLimits = newRateLimiter(100, 200)
+
+/*allowRequest checks that a customer hasn't made too many filter requests
+recently, either from the host itself or from the rest of its network.  Each
+flow in a batch counts as a separate request.*/
+func allowRequest(from net.IP, n int) bool {
+	if !hostLimits.AllowN(from.String(), n) {
+		return false
+	}
+
+	if prefix := customers.Match(from); prefix != nil {
+		return prefixLimits.AllowN(prefix.String(), n)
+	}
+
+	return true
+}
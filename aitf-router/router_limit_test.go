@@ -0,0 +1,73 @@
+package main
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/ThomasJClark/cs4404project/aitf/filter"
+)
+
+func TestRateLimiter(t *testing.T) {
+	tests := []struct {
+		name  string
+		rate  float64
+		burst int
+		idle  time.Duration /*How long the sender waits before each request*/
+		n     []int
+		want  []bool
+	}{
+		{"burst", 1, 3, 0, []int{1, 1, 1, 1}, []bool{true, true, true, false}},
+		{"batch", 1, 3, 0, []int{2, 2, 1}, []bool{true, false, true}},
+		{"batch bigger than burst", 1, 3, 0, []int{4, 3}, []bool{false, true}},
+		{"refill", 2, 2, 500 * time.Millisecond, []int{2, 1, 1, 2}, []bool{true, true, true, false}},
+		{"refill up to burst", 10, 2, time.Hour, []int{2, 2, 3}, []bool{true, true, false}},
+		{"no limit", 0, 0, 0, []int{100, 100}, []bool{true, true}},
+	}
+
+	for _, test := range tests {
+		l := newRateLimiter(test.rate, test.burst)
+		for i, n := range test.n {
+			if b := l.buckets["sender"]; b != nil {
+				b.last = b.last.Add(-test.idle)
+			}
+
+			if got := l.AllowN("sender", n); got != test.want[i] {
+				t.Errorf("%s: request %d for %d tokens returned %v, want %v", test.name, i, n, got, test.want[i])
+			}
+		}
+	}
+}
+
+func TestRateLimiterSenders(t *testing.T) {
+	l := newRateLimiter(1, 1)
+	if !l.Allow("a") || !l.Allow("b") {
+		t.Error("each sender should get its own bucket")
+	}
+
+	if l.Allow("a") {
+		t.Error("a's bucket should be empty")
+	}
+}
+
+func TestFullBatchAllowed(t *testing.T) {
+	tests := []struct {
+		name   string
+		limits *rateLimiter
+	}{
+		{"host", hostLimits},
+		{"prefix", prefixLimits},
+		{"peer", peerLimits},
+	}
+
+	for _, test := range tests {
+		l := newRateLimiter(test.limits.rate, int(test.limits.burst))
+		if !l.AllowN("sender", filter.MaxBatchSize) {
+			t.Errorf("%s: a full batch of %d flows was refused by default", test.name, filter.MaxBatchSize)
+		}
+	}
+
+	if !allowRequest(net.ParseIP("10.4.31.2"), filter.MaxBatchSize) {
+		t.Errorf("a customer's full batch of %d flows was refused", filter.MaxBatchSize)
+	}
+}
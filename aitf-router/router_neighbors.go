@@ -0,0 +1,222 @@
+package main
+
+import (
+	"expvar"
+	"log"
+	"net"
+	"time"
+
+	"github.com/ThomasJClark/cs4404project/aitf"
+	"github.com/ThomasJClark/cs4404project/aitf/filter"
+)
+
+/*helloInterval is how often hello messages are sent to every known neighbour.
+A neighbour that hasn't been heard from in three intervals is forgotten.*/
+var helloInterval = 30 * time.Second
+
+/*neighbor is what we know about another AITF router from its hello messages.*/
+type neighbor struct {
+	Hello    filter.HelloInfo
+	LastSeen time.Time
+}
+
+/*
+neighbors holds every router that we've heard a hello from, and probes holds
+when we last sent a hello to routers that haven't answered.  They're only used
+while holding stateMutex.
+*/
+var neighbors = make(map[string]*neighbor)
+var probes = make(map[string]time.Time)
+
+/*maxNeighbors and maxProbes are the most entries that neighbors and probes can
+have, so they can't use up unlimited memory.*/
+const maxNeighbors = 1024
+const maxProbes = 1024
+
+/*helloLimits limits how many hellos from unknown routers we answer, since the
+sender's address might be spoofed.  Every unknown router shares one bucket.*/
+var helloLimits = newRateLimiter(10, 20)
+
+/*staticNeighbors are the routers given on the command line, which are sent
+hellos even before they've been heard from.*/
+var staticNeighbors []net.IP
+
+/*localMode is how this router handles filter requests, as chosen on the
+command line.  It's advertised in hellos.*/
+var localMode complianceMode
+
+func init() {
+	expvar.Publish("neighbors", expvar.Func(func() interface{} {
+		stateMutex.Lock()
+		defer stateMutex.Unlock()
+
+		known := make(map[string]neighbor)
+		for ip, n := range neighbors {
+			known[ip] = *n
+		}
+
+		return known
+	}))
+}
+
+/*localHello returns what this router advertises about itself.*/
+func localHello() filter.HelloInfo {
+	info := filter.HelloInfo{Version: filter.ProtocolVersion, Capabilities: filter.CapBatch, Quota: uint32(peerQuota)}
+	if localMode == comply || localMode == lie {
+		info.Capabilities |= filter.CapFilter
+	}
+
+	if keys.Len() > 0 {
+		info.Capabilities |= filter.CapSigned
+	}
+
+	return info
+}
+
+/*
+trustedNeighbor returns true if hellos from a router can be believed: it's
+either a static neighbour, on the key ring (so its hellos are signed), or a
+router that we sent a hello to recently.  Otherwise, anyone could spoof hellos
+to fill up the neighbour table, or to make us skip a real attacker's router.
+The caller must hold stateMutex.
+*/
+func trustedNeighbor(ip net.IP) bool {
+	for _, static := range staticNeighbors {
+		if static.Equal(ip) {
+			return true
+		}
+	}
+
+	if keys.Has(ip) {
+		return true
+	}
+
+	probed, ok := probes[ip.String()]
+	return ok && time.Since(probed) < 3*helloInterval
+}
+
+/*
+handleHello records a neighbour's advertisement, and answers it with our own if
+it's a hello and not already an answer.  Hellos from routers we don't trust are
+still answered, so other routers can discover us, but they aren't recorded.
+The caller must hold stateMutex.
+*/
+func handleHello(req filter.Request, addr *net.UDPAddr) {
+	ip := addr.IP.String()
+	trusted := trustedNeighbor(addr.IP)
+
+	if req.Type == filter.Hello && (trusted || helloLimits.Allow("")) {
+		endpoint.SendTo(filter.NewHello(filter.HelloAck, localHello()), addr)
+	}
+
+	if !trusted {
+		log.Println("Not recording a", req.Type, "from", aitf.Hostname(addr.IP), "since we never asked it.")
+		stats.Add("untrustedHellos", 1)
+		return
+	}
+
+	if neighbors[ip] == nil && len(neighbors) >= maxNeighbors {
+		log.Println("Too many neighbours. Not recording", aitf.Hostname(addr.IP))
+		return
+	}
+
+	if neighbors[ip] == nil || neighbors[ip].Hello != req.Hello {
+		log.Println(aitf.Hostname(addr.IP), "runs AITF version", req.Hello.Version,
+			"with capabilities", req.Hello.Capabilities, "and a quota of", req.Hello.Quota)
+	}
+
+	neighbors[ip] = &neighbor{Hello: req.Hello, LastSeen: time.Now()}
+	delete(probes, ip)
+}
+
+/*
+lookupNeighbor returns what we know about a router, if it's answered a hello
+recently.  If it hasn't, and we haven't asked in a while, a hello is sent so
+we'll know next time.  The caller must hold stateMutex.
+*/
+func lookupNeighbor(ip net.IP) (*neighbor, bool) {
+	n := neighbors[ip.String()]
+	if n != nil && time.Since(n.LastSeen) < 3*helloInterval {
+		return n, true
+	}
+
+	if time.Since(probes[ip.String()]) > helloInterval {
+		if len(probes) >= maxProbes {
+			pruneProbes()
+		}
+
+		if len(probes) < maxProbes {
+			log.Println("Don't know if", aitf.Hostname(ip), "runs AITF. Saying hello.")
+			probes[ip.String()] = time.Now()
+			endpoint.Send(filter.NewHello(filter.Hello, localHello()), ip)
+		}
+	}
+
+	return nil, false
+}
+
+/*pruneProbes forgets hellos that have gone unanswered for too long to be
+trusted anyway.  The caller must hold stateMutex.*/
+func pruneProbes() {
+	for ip, probed := range probes {
+		if time.Since(probed) >= 3*helloInterval {
+			delete(probes, ip)
+		}
+	}
+}
+
+/*
+willFilter returns false if a router is known not to take over n more filters,
+either because it doesn't support counter-connections or because its quota is
+too small.  Routers that we haven't heard from are assumed to, so the
+counter-connection timeout takes care of them.  The caller must hold
+stateMutex.
+*/
+func willFilter(router net.IP, n int) bool {
+	neighbor, ok := lookupNeighbor(router)
+	if !ok {
+		return true
+	}
+
+	return neighbor.Hello.Capabilities&filter.CapFilter != 0 && int(neighbor.Hello.Quota) >= n
+}
+
+/*acceptsBatches returns false if a router is known not to accept batched
+counter-connections.  The caller must hold stateMutex.*/
+func acceptsBatches(router net.IP) bool {
+	neighbor, ok := lookupNeighbor(router)
+	return !ok || neighbor.Hello.Capabilities&filter.CapBatch != 0
+}
+
+/*
+helloPeriodically sends a hello to every known neighbour and every static
+neighbour each interval, and forgets neighbours that have stopped answering.
+*/
+func helloPeriodically() {
+	for {
+		stateMutex.Lock()
+
+		targets := make(map[string]net.IP)
+		for _, ip := range staticNeighbors {
+			targets[ip.String()] = ip
+		}
+
+		for ip, n := range neighbors {
+			if time.Since(n.LastSeen) > 3*helloInterval {
+				log.Println("Haven't heard from", aitf.Hostname(net.ParseIP(ip)), "in a while. Forgetting it.")
+				delete(neighbors, ip)
+			} else {
+				targets[ip] = net.ParseIP(ip)
+			}
+		}
+
+		for _, ip := range targets {
+			endpoint.Send(filter.NewHello(filter.Hello, localHello()), ip)
+		}
+
+		pruneProbes()
+
+		stateMutex.Unlock()
+		time.Sleep(helloInterval)
+	}
+}
@@ -0,0 +1,37 @@
+package main
+
+import (
+	"net"
+)
+
+/*peerQuota is the most filters that we'll handle at once on behalf of any one
+router, as the attacker's router.*/
+var peerQuota = 1000
+
+/*peerLimits limits how many counter-connections each router can start.*/
+var peerLimits = newRateLimiter(50, 100)
+
+/*
+activeFilters counts the filters that we're currently handling on behalf of a
+router.  A filter is active while we either have it installed or have a shadow
+filter making sure the attacker complies.  Filters that are no longer active
+are forgotten along the way.
+*/
+func activeFilters(peer net.IP) int {
+	n := 0
+	for key, requester := range requesters {
+		if _, ok := shadows.Get(key); !ok && !filters.Contains(key) {
+			delete(requesters, key)
+		} else if requester.Equal(peer) {
+			n++
+		}
+	}
+
+	return n
+}
+
+/*overQuota returns true if a router doesn't have room in its quota for n more
+active filters.*/
+func overQuota(peer net.IP, n int) bool {
+	return activeFilters(peer)+n > peerQuota
+}
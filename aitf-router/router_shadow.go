@@ -0,0 +1,180 @@
+package main
+
+import (
+	"log"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/ThomasJClark/cs4404project/aitf"
+	"github.com/ThomasJClark/cs4404project/aitf/filter"
+)
+
+/*shadowGracePeriod is how long after a shadow filter is added that matching
+traffic is ignored, since packets that were already in flight may still arrive.*/
+const shadowGracePeriod = 100 * time.Millisecond
+
+/*shadowFilter remembers a flow that another node has agreed to filter, and
+which node that was.*/
+type shadowFilter struct {
+	req      filter.Request
+	peer     net.IP
+	hop      int /*The index in the route record of the router that agreed to filter*/
+	added    time.Time
+	expires  time.Time
+	renewals int
+}
+
+/*
+shadowTable holds the shadow filters on this router.  A shadow filter doesn't
+block anything.  Instead, it watches forwarded traffic for a flow that should
+be blocked somewhere else, so we can tell when another node isn't complying
+with a filter request.
+
+Each shadow filter lasts as long as the filter that the other node agreed to.
+After that, the flow is allowed to come back.
+*/
+type shadowTable struct {
+	mu         sync.Mutex
+	filters    map[filter.FlowKey]*shadowFilter
+	violations chan shadowFilter
+}
+
+var shadows = &shadowTable{
+	filters:    make(map[filter.FlowKey]*shadowFilter),
+	violations: make(chan shadowFilter, 100),
+}
+
+/*Add starts watching for a flow that another node agreed to filter.*/
+func (t *shadowTable) Add(shadow shadowFilter) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	shadow.added = time.Now()
+	shadow.expires = shadow.added.Add(filter.LongFilterTime)
+	t.filters[shadow.req.Key()] = &shadow
+}
+
+/*Get returns the shadow filter for a flow, if there is one.*/
+func (t *shadowTable) Get(key filter.FlowKey) (shadowFilter, bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	shadow := t.get(key)
+	if shadow == nil {
+		return shadowFilter{}, false
+	}
+
+	return *shadow, true
+}
+
+/*Watching returns true if there's a shadow filter for a flow.*/
+func (t *shadowTable) Watching(key filter.FlowKey) bool {
+	_, ok := t.Get(key)
+	return ok
+}
+
+/*Remove stops watching for a flow.*/
+func (t *shadowTable) Remove(key filter.FlowKey) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	delete(t.filters, key)
+}
+
+/*Renew keeps watching for a flow for as long as the other node will now filter
+it, which grows with each renewal just like a regular filter.*/
+func (t *shadowTable) Renew(key filter.FlowKey) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if shadow := t.get(key); shadow != nil {
+		shadow.renewals++
+		shadow.expires = time.Now().Add(filter.RenewalTime(shadow.renewals))
+	}
+}
+
+/*
+Match checks a forwarded packet against the shadow filters.  If the packet
+belongs to a flow that another node should be filtering, the shadow filter is
+removed and a violation is raised, and true is returned so the packet can be
+dropped.
+
+This is called for every forwarded packet, so it doesn't do anything slow while
+holding the lock.
+*/
+func (t *shadowTable) Match(srcIP, dstIP net.IP) bool {
+	req := filter.Request{SrcIP: srcIP, DstIP: dstIP}
+
+	t.mu.Lock()
+	shadow := t.get(req.Key())
+	if shadow == nil || time.Since(shadow.added) < shadowGracePeriod {
+		t.mu.Unlock()
+		return false
+	}
+
+	delete(t.filters, req.Key())
+	t.mu.Unlock()
+
+	select {
+	case t.violations <- *shadow:
+	default:
+		log.Println("Too many violations to handle. Ignoring", req.Key())
+	}
+
+	return true
+}
+
+/*get returns the shadow filter for a flow, forgetting it first if it's expired.
+The caller must hold t.mu.*/
+func (t *shadowTable) get(key filter.FlowKey) *shadowFilter {
+	shadow := t.filters[key]
+	if shadow != nil && time.Now().After(shadow.expires) {
+		delete(t.filters, key)
+		return nil
+	}
+
+	return shadow
+}
+
+/*expirePeriodically forgets shadow filters once they've expired, even if no
+traffic from their flows ever shows up again.*/
+func (t *shadowTable) expirePeriodically() {
+	for _ = range time.Tick(filter.LongFilterTime) {
+		t.mu.Lock()
+		for key := range t.filters {
+			t.get(key)
+		}
+		t.mu.Unlock()
+	}
+}
+
+/*handleViolations takes action whenever a shadow filter sees a flow that
+another node should have stopped.*/
+func handleViolations() {
+	for shadow := range shadows.violations {
+		stateMutex.Lock()
+		handleViolation(shadow)
+		stateMutex.Unlock()
+	}
+}
+
+/*
+handleViolation deals with a node that didn't comply with a filter request.  If
+it was a router, the filter is escalated to the next router up the path.  If it
+was the attacker itself, we're its gateway, so we disconnect it.
+
+The caller must hold stateMutex.
+*/
+func handleViolation(shadow shadowFilter) {
+	key := shadow.req.Key()
+
+	log.Println(aitf.Hostname(shadow.peer), "agreed to filter", key, "but it's still coming through!")
+	stats.Add("violations", 1)
+
+	if shadow.peer.Equal(shadow.req.SrcIP) {
+		disconnect(shadow.req.SrcIP, key)
+	} else {
+		escalate(shadow.req, shadow.hop+1)
+	}
+}
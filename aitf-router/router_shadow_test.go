@@ -0,0 +1,86 @@
+package main
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/ThomasJClark/cs4404project/aitf/filter"
+)
+
+func newTestShadowTable() *shadowTable {
+	return &shadowTable{
+		filters:    make(map[filter.FlowKey]*shadowFilter),
+		violations: make(chan shadowFilter, 1),
+	}
+}
+
+func TestShadowMatch(t *testing.T) {
+	src, dst := net.ParseIP("10.4.32.4"), net.ParseIP("10.4.31.2")
+	req := filter.Request{SrcIP: src, DstIP: dst}
+
+	tests := []struct {
+		name    string
+		age     time.Duration /*How long ago the shadow filter was added*/
+		expires time.Duration /*How long until it expires, from now*/
+		match   bool
+	}{
+		{"in grace period", 0, filter.LongFilterTime, false},
+		{"after grace period", 2 * shadowGracePeriod, filter.LongFilterTime, true},
+		{"expired", filter.LongFilterTime, -time.Millisecond, false},
+	}
+
+	for _, test := range tests {
+		shadows := newTestShadowTable()
+		shadows.Add(shadowFilter{req: req, peer: net.ParseIP("10.4.32.3")})
+		shadow := shadows.filters[req.Key()]
+		shadow.added = time.Now().Add(-test.age)
+		shadow.expires = time.Now().Add(test.expires)
+
+		if match := shadows.Match(src, dst); match != test.match {
+			t.Errorf("%s: Match() = %v, want %v", test.name, match, test.match)
+		}
+
+		/*A match raises a violation and stops watching, so a flood of packets
+		only escalates once.  An expired shadow filter is just forgotten.*/
+		_, ok := shadows.Get(req.Key())
+		if test.match && ok {
+			t.Errorf("%s: shadow filter kept after a match", test.name)
+		}
+
+		if len(shadows.violations) != 0 != test.match {
+			t.Errorf("%s: %d violations raised", test.name, len(shadows.violations))
+		}
+
+		if test.match && shadows.Match(src, dst) {
+			t.Errorf("%s: matched again after the violation", test.name)
+		}
+	}
+}
+
+func TestShadowExpiry(t *testing.T) {
+	req := filter.Request{SrcIP: net.ParseIP("10.4.32.4"), DstIP: net.ParseIP("10.4.31.2")}
+
+	shadows := newTestShadowTable()
+	shadows.Add(shadowFilter{req: req})
+	if _, ok := shadows.Get(req.Key()); !ok {
+		t.Fatal("new shadow filter is missing")
+	}
+
+	for renewals := 1; renewals <= 3; renewals++ {
+		shadows.Renew(req.Key())
+		shadow, _ := shadows.Get(req.Key())
+		if left := time.Until(shadow.expires); left <= filter.RenewalTime(renewals-1) || left > filter.RenewalTime(renewals) {
+			t.Errorf("after %d renewals, the shadow filter expires in %v, want %v", renewals, left, filter.RenewalTime(renewals))
+		}
+	}
+
+	shadows.filters[req.Key()].expires = time.Now().Add(-time.Millisecond)
+	if _, ok := shadows.Get(req.Key()); ok {
+		t.Error("expired shadow filter is still there")
+	}
+
+	if len(shadows.filters) != 0 {
+		t.Error("expired shadow filter wasn't forgotten")
+	}
+}
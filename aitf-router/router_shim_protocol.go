@@ -49,6 +49,13 @@ func addRouteRecords() {
 			log.Println("Got", ipLayer.Protocol, "packet from", aitf.Hostname(ipLayer.SrcIP), "for", aitf.Hostname(ipLayer.DstIP))
 		}
 
+		/*If another node agreed to filter this flow, it's not complying.  Drop the
+		packet and let the filter protocol deal with it.*/
+		if shadows.Match(ipLayer.SrcIP, ipLayer.DstIP) {
+			packet.SetVerdict(netfilter.NF_DROP)
+			continue
+		}
+
 		/*Shim up the packet. One of the assumptions made is that each route knows
 		which hosts support AITF. All hosts in the test scenerios do, so there's
 		never a need for a router to remove the shim layer.*/
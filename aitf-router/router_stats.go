@@ -0,0 +1,25 @@
+package main
+
+import (
+	"expvar"
+	"log"
+	"net/http"
+)
+
+/*stats counts notable events in the filter protocol, such as forged messages.
+The counters are published with expvar, so they can be read over HTTP at
+/debug/vars when the status server is running.*/
+var stats = expvar.NewMap("aitf")
+
+func init() {
+	expvar.Publish("aggregates", expvar.Func(func() interface{} {
+		return filters.Aggregates()
+	}))
+}
+
+/*serveStatus runs an HTTP server on the given address for reading the router's
+statistics.*/
+func serveStatus(addr string) {
+	log.Println("Serving statistics on", addr)
+	log.Println(http.ListenAndServe(addr, nil))
+}
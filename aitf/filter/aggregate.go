@@ -0,0 +1,218 @@
+package filter
+
+import (
+	"fmt"
+	"log"
+	"net"
+
+	"github.com/ThomasJClark/cs4404project/aitf"
+)
+
+/*MinAggregatePrefixLen is the shortest source prefix that filters can ever be
+aggregated into, no matter what the policy says.  This keeps a misconfiguration
+from blocking huge parts of the Internet at once.*/
+const MinAggregatePrefixLen = 16
+
+/*
+Aggregation is the policy for combining filters into prefix filters.  During a
+distributed attack, a node can end up with many filters from hosts in the same
+few networks to the same victim.  Once there are Threshold of them in one
+PrefixLen-bit source prefix, they're replaced with a single firewall rule for
+the whole prefix.  When fewer than Release of them are left, the prefix rule is
+split back up into rules for the individual hosts.
+
+The individual filters are still kept in the table while they're aggregated, so
+they expire and get renewed the same way as before.
+
+Only long-term filters count toward Threshold and Release.  Temporary filters
+only last while a flow is handed off to another node, so they'd only lead to
+prefix filters that block innocent hosts for much longer than the attack.
+*/
+type Aggregation struct {
+	/*PrefixLen is the length of the source prefixes that filters are
+	aggregated into, or 0 to never aggregate.*/
+	PrefixLen int
+
+	/*Threshold is how many filters in a prefix it takes to aggregate them.*/
+	Threshold int
+
+	/*Release is the number of filters in an aggregated prefix below which it's
+	split up again.  It should be less than Threshold, so a prefix doesn't keep
+	flapping back and forth.*/
+	Release int
+
+	/*Exempt are source networks that must never be covered by a prefix filter,
+	such as important peers.  Filters on hosts in them are still installed
+	individually.*/
+	Exempt aitf.PrefixList
+
+	/*Skip, if it's set, returns true for flows that shouldn't count toward a
+	prefix filter right now, such as flows that are being watched to see if
+	another node filters them.*/
+	Skip func(key FlowKey) bool
+}
+
+/*Validate returns an error if the policy could block more than it should.*/
+func (a Aggregation) Validate() error {
+	if a.PrefixLen == 0 {
+		return nil
+	}
+
+	if a.PrefixLen < MinAggregatePrefixLen || a.PrefixLen >= 32 {
+		return fmt.Errorf("aggregate prefixes must be between /%d and /31", MinAggregatePrefixLen)
+	}
+
+	if a.Threshold < 2 {
+		return fmt.Errorf("it takes at least 2 filters to aggregate")
+	}
+
+	if a.Release >= a.Threshold {
+		return fmt.Errorf("the release threshold must be less than the aggregation threshold")
+	}
+
+	return nil
+}
+
+/*aggregateKey identifies the prefix filter that a flow falls under.  SrcIP is
+the first address of the source prefix.*/
+type aggregateKey FlowKey
+
+/*aggregateFilter is the state of a prefix filter in a Table.*/
+type aggregateFilter struct {
+	prefix *net.IPNet
+}
+
+/*aggregateFor returns the prefix filter that a flow would fall under, or false
+if flows like it are never aggregated.  The caller must hold t.mu.*/
+func (t *Table) aggregateFor(key FlowKey) (aggregateKey, *net.IPNet, bool) {
+	a := t.Aggregation
+	if a.PrefixLen < MinAggregatePrefixLen || a.PrefixLen >= 32 || key.DstIP == [4]byte{} {
+		return aggregateKey{}, nil, false
+	}
+
+	mask := net.CIDRMask(a.PrefixLen, 32)
+	prefix := &net.IPNet{IP: net.IP(key.SrcIP[:]).Mask(mask), Mask: mask}
+	for _, exempt := range a.Exempt {
+		if exempt.Contains(prefix.IP) || prefix.Contains(exempt.IP) {
+			return aggregateKey{}, nil, false
+		}
+	}
+
+	ak := aggregateKey{DstIP: key.DstIP}
+	copy(ak.SrcIP[:], prefix.IP)
+	return ak, prefix, true
+}
+
+/*members returns the filters that fall under a prefix filter, and how many of
+them count toward it.  The caller must hold t.mu.*/
+func (t *Table) members(ak aggregateKey, prefix *net.IPNet) ([]FlowKey, int) {
+	var keys []FlowKey
+	counted := 0
+	for key, f := range t.filters {
+		if key.DstIP == ak.DstIP && prefix.Contains(net.IP(key.SrcIP[:])) {
+			keys = append(keys, key)
+			if t.counts(key, f) {
+				counted++
+			}
+		}
+	}
+
+	return keys, counted
+}
+
+/*counts returns true if a filter counts toward the prefix filter it falls
+under.  The caller must hold t.mu.*/
+func (t *Table) counts(key FlowKey, f *installedFilter) bool {
+	if f.priority < PriorityNormal {
+		return false
+	}
+
+	return t.Aggregation.Skip == nil || !t.Aggregation.Skip(key)
+}
+
+/*
+aggregate replaces the filters in the same prefix as key with a single prefix
+filter, if enough of them count toward it.  It's called after a filter is
+installed or its priority is raised.  The caller must hold t.mu.
+*/
+func (t *Table) aggregate(key FlowKey) {
+	ak, prefix, ok := t.aggregateFor(key)
+	if !ok || t.aggregates[ak] != nil {
+		return
+	}
+
+	members, counted := t.members(ak, prefix)
+	if counted < t.Aggregation.Threshold {
+		return
+	}
+
+	log.Printf("Aggregating %d filters into [%s to %s]", len(members), prefix, net.IP(ak.DstIP[:]))
+	if err := iptablesPrefix("-I", FlowKey(ak), t.Aggregation.PrefixLen, t.forward); err != nil {
+		log.Println(err)
+		return
+	}
+
+	t.aggregates[ak] = &aggregateFilter{prefix: prefix}
+	for _, member := range members {
+		if err := iptables("-D", member, t.forward); err != nil {
+			log.Println(err)
+		}
+
+		t.filters[member].covered = true
+	}
+}
+
+/*
+release splits up the prefix filter that key falls under, if there aren't
+enough filters left in it.  It's called after a filter is removed.  The caller
+must hold t.mu.
+*/
+func (t *Table) release(key FlowKey) {
+	ak, _, ok := t.aggregateFor(key)
+	if !ok || t.aggregates[ak] == nil {
+		return
+	}
+
+	agg := t.aggregates[ak]
+	members, counted := t.members(ak, agg.prefix)
+	if counted >= t.Aggregation.Release && counted > 0 {
+		return
+	}
+
+	log.Printf("Splitting [%s to %s] back into %d filters", agg.prefix, net.IP(ak.DstIP[:]), len(members))
+
+	/*Put the individual rules back before taking out the prefix rule, so the
+	remaining flows are never let through in between.*/
+	for _, member := range members {
+		if err := iptables("-I", member, t.forward); err != nil {
+			log.Println(err)
+		}
+
+		t.filters[member].covered = false
+	}
+
+	delete(t.aggregates, ak)
+	if err := iptablesPrefix("-D", FlowKey(ak), t.Aggregation.PrefixLen, t.forward); err != nil {
+		log.Println(err)
+	}
+}
+
+/*covering returns true if a new filter on the flow would already be covered by
+a prefix filter.  The caller must hold t.mu.*/
+func (t *Table) covering(key FlowKey) bool {
+	ak, _, ok := t.aggregateFor(key)
+	return ok && t.aggregates[ak] != nil
+}
+
+/*Aggregates returns the prefix filters that are currently installed.*/
+func (t *Table) Aggregates() []string {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	var aggregates []string
+	for ak, agg := range t.aggregates {
+		aggregates = append(aggregates, fmt.Sprintf("[%s to %s]", agg.prefix, net.IP(ak.DstIP[:])))
+	}
+
+	return aggregates
+}
@@ -0,0 +1,73 @@
+package filter
+
+import (
+	"net"
+	"testing"
+)
+
+func TestAggregationValidate(t *testing.T) {
+	tests := []struct {
+		name  string
+		a     Aggregation
+		valid bool
+	}{
+		{"disabled", Aggregation{}, true},
+		{"defaults", Aggregation{PrefixLen: 24, Threshold: 16, Release: 4}, true},
+		{"shortest prefix", Aggregation{PrefixLen: MinAggregatePrefixLen, Threshold: 2, Release: 1}, true},
+		{"longest prefix", Aggregation{PrefixLen: 31, Threshold: 2}, true},
+		{"prefix too short", Aggregation{PrefixLen: MinAggregatePrefixLen - 1, Threshold: 16, Release: 4}, false},
+		{"host prefix", Aggregation{PrefixLen: 32, Threshold: 16, Release: 4}, false},
+		{"negative prefix", Aggregation{PrefixLen: -8, Threshold: 16, Release: 4}, false},
+		{"threshold too low", Aggregation{PrefixLen: 24, Threshold: 1}, false},
+		{"release equals threshold", Aggregation{PrefixLen: 24, Threshold: 4, Release: 4}, false},
+		{"release above threshold", Aggregation{PrefixLen: 24, Threshold: 4, Release: 8}, false},
+	}
+
+	for _, test := range tests {
+		if err := test.a.Validate(); (err == nil) != test.valid {
+			t.Errorf("%s: Validate() = %v, want valid %v", test.name, err, test.valid)
+		}
+	}
+}
+
+func TestAggregateMembers(t *testing.T) {
+	victim := net.ParseIP("10.4.31.2")
+	shadowed := Request{SrcIP: net.ParseIP("10.4.32.9"), DstIP: victim}
+
+	table := NewTable(true)
+	table.Aggregation = Aggregation{
+		PrefixLen: 24,
+		Threshold: 2,
+		Skip:      func(key FlowKey) bool { return key == shadowed.Key() },
+	}
+
+	filters := []struct {
+		src      string
+		dst      net.IP
+		priority Priority
+	}{
+		{"10.4.32.4", victim, PriorityNormal},
+		{"10.4.32.5", victim, PriorityEscalated},
+		{"10.4.32.6", victim, PriorityTemporary},
+		{"10.4.32.9", victim, PriorityNormal},
+		{"10.4.33.4", victim, PriorityNormal},
+		{"10.4.32.4", net.ParseIP("10.4.31.3"), PriorityNormal},
+	}
+
+	for _, f := range filters {
+		req := Request{SrcIP: net.ParseIP(f.src), DstIP: f.dst}
+		table.filters[req.Key()] = &installedFilter{priority: f.priority}
+	}
+
+	ak, prefix, ok := table.aggregateFor(shadowed.Key())
+	if !ok {
+		t.Fatal("flow isn't aggregated")
+	}
+
+	/*Every filter in the prefix is covered by it, but only the long-term ones
+	that aren't being watched count toward it.*/
+	members, counted := table.members(ak, prefix)
+	if len(members) != 4 || counted != 2 {
+		t.Errorf("members() = %d filters with %d counted, want 4 with 2 counted", len(members), counted)
+	}
+}
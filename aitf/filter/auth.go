@@ -0,0 +1,215 @@
+package filter
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/ed25519"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"strings"
+)
+
+var (
+	/*ErrNoKey is returned when verifying a message from a node that we don't
+	have a key for.*/
+	ErrNoKey = errors.New("no key for peer")
+
+	/*ErrBadSignature is returned when a message's signature doesn't match.*/
+	ErrBadSignature = errors.New("bad signature")
+)
+
+/*Key signs messages sent to a peer router and verifies messages from it.*/
+type Key interface {
+	Sign(msg []byte) []byte
+	Verify(msg, sig []byte) bool
+}
+
+/*HMACKey is a secret key shared with a peer router.  Messages are signed with
+HMAC-SHA256.*/
+type HMACKey []byte
+
+func (key HMACKey) Sign(msg []byte) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write(msg)
+	return mac.Sum(nil)
+}
+
+func (key HMACKey) Verify(msg, sig []byte) bool {
+	return hmac.Equal(key.Sign(msg), sig)
+}
+
+/*Ed25519Key signs messages with this router's private key, and verifies them
+with the public key of a peer router.*/
+type Ed25519Key struct {
+	Private ed25519.PrivateKey
+	Public  ed25519.PublicKey
+}
+
+func (key Ed25519Key) Sign(msg []byte) []byte {
+	return ed25519.Sign(key.Private, msg)
+}
+
+func (key Ed25519Key) Verify(msg, sig []byte) bool {
+	return ed25519.Verify(key.Public, msg, sig)
+}
+
+/*
+KeyRing holds the keys used to authenticate messages exchanged with other
+routers.  Messages to and from nodes that aren't on the key ring, such as
+hosts, aren't signed.
+
+A KeyRing must not be changed once it's being used.
+*/
+type KeyRing struct {
+	keys map[[4]byte]Key
+}
+
+/*NewKeyRing creates an empty key ring.*/
+func NewKeyRing() *KeyRing {
+	return &KeyRing{keys: make(map[[4]byte]Key)}
+}
+
+/*
+LoadKeyRing reads the keys for peer routers from a file.  Each line of the file
+has the IP address of a peer, the type of key, and the key in hex:
+
+	10.4.32.3 hmac 8f2d...
+	10.4.32.5 ed25519 3b6a...
+
+For hmac keys, the key is a shared secret.  For ed25519 keys, it's the peer's
+public key, and messages to the peer are signed with the given private key.
+Blank lines and lines starting with # are ignored.
+*/
+func LoadKeyRing(path string, private ed25519.PrivateKey) (*KeyRing, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+
+	defer f.Close()
+
+	keys := NewKeyRing()
+	scanner := bufio.NewScanner(f)
+	for line := 1; scanner.Scan(); line++ {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 || strings.HasPrefix(fields[0], "#") {
+			continue
+		}
+
+		if len(fields) != 3 {
+			return nil, fmt.Errorf("%s:%d: expected an address, key type, and key", path, line)
+		}
+
+		peer := net.ParseIP(fields[0])
+		if peer == nil {
+			return nil, fmt.Errorf("%s:%d: invalid address %q", path, line, fields[0])
+		}
+
+		secret, err := hex.DecodeString(fields[2])
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: %s", path, line, err)
+		}
+
+		switch fields[1] {
+		case "hmac":
+			keys.Add(peer, HMACKey(secret))
+		case "ed25519":
+			if private == nil {
+				return nil, fmt.Errorf("%s:%d: ed25519 keys need a private signing key", path, line)
+			}
+
+			if len(secret) != ed25519.PublicKeySize {
+				return nil, fmt.Errorf("%s:%d: ed25519 public keys are %d bytes", path, line, ed25519.PublicKeySize)
+			}
+
+			keys.Add(peer, Ed25519Key{Private: private, Public: ed25519.PublicKey(secret)})
+		default:
+			return nil, fmt.Errorf("%s:%d: unknown key type %q", path, line, fields[1])
+		}
+	}
+
+	return keys, scanner.Err()
+}
+
+/*LoadSigningKey reads an Ed25519 private key from a file containing its 32-byte
+seed in hex.*/
+func LoadSigningKey(path string) (ed25519.PrivateKey, error) {
+	contents, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	seed, err := hex.DecodeString(strings.TrimSpace(string(contents)))
+	if err != nil {
+		return nil, err
+	}
+
+	if len(seed) != ed25519.SeedSize {
+		return nil, fmt.Errorf("%s: ed25519 seeds are %d bytes", path, ed25519.SeedSize)
+	}
+
+	return ed25519.NewKeyFromSeed(seed), nil
+}
+
+/*Add sets the key used for messages to and from a peer.*/
+func (keys *KeyRing) Add(peer net.IP, key Key) {
+	var ip [4]byte
+	copy(ip[:], peer.To4())
+	keys.keys[ip] = key
+}
+
+/*Has returns true if there's a key for the given peer.*/
+func (keys *KeyRing) Has(peer net.IP) bool {
+	return keys.get(peer) != nil
+}
+
+/*Len returns the number of peers on the key ring.*/
+func (keys *KeyRing) Len() int {
+	return len(keys.keys)
+}
+
+func (keys *KeyRing) get(peer net.IP) Key {
+	var ip [4]byte
+	copy(ip[:], peer.To4())
+	return keys.keys[ip]
+}
+
+/*Sign signs a request that's about to be sent to a peer, if there's a key for
+that peer.*/
+func (keys *KeyRing) Sign(req *Request, to net.IP) {
+	if key := keys.get(to); key != nil {
+		req.Signature = key.Sign(req.signedBytes())
+	}
+}
+
+/*Verify checks the signature of a request that came from a peer.  If there's
+no key for the peer, ErrNoKey is returned.*/
+func (keys *KeyRing) Verify(req *Request, from net.IP) error {
+	key := keys.get(from)
+	if key == nil {
+		return ErrNoKey
+	}
+
+	if !key.Verify(req.signedBytes(), req.Signature) {
+		return ErrBadSignature
+	}
+
+	return nil
+}
+
+/*signedBytes returns the binary encoding of a request without its signature,
+which is what the signature is computed over.*/
+func (req *Request) signedBytes() []byte {
+	unsigned := *req
+	unsigned.Signature = nil
+
+	var b bytes.Buffer
+	unsigned.WriteTo(&b)
+	return b.Bytes()
+}
@@ -0,0 +1,74 @@
+package filter
+
+import (
+	"crypto/ed25519"
+	"net"
+	"testing"
+)
+
+func TestSignatureCoversFields(t *testing.T) {
+	peer := net.ParseIP("10.4.32.3")
+
+	_, private, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	keys := map[string]Key{
+		"hmac":    HMACKey("secret"),
+		"ed25519": Ed25519Key{Private: private, Public: private.Public().(ed25519.PublicKey)},
+	}
+
+	tamper := map[string]func(req *Request){
+		"nonce":     func(req *Request) { req.Nonce++ },
+		"reason":    func(req *Request) { req.Reason = ReasonNone },
+		"timestamp": func(req *Request) { req.Timestamp++ },
+		"id":        func(req *Request) { req.ID++ },
+		"batch src": func(req *Request) { req.Batch[0].SrcIP = net.ParseIP("10.4.32.9") },
+		"batch dst": func(req *Request) { req.Batch[0].DstIP = net.ParseIP("10.4.31.9") },
+		"batch flow": func(req *Request) {
+			req.Batch[0].Flow = testRecord("10.4.32.9")
+		},
+		"batch dropped": func(req *Request) { req.Batch = nil },
+	}
+
+	helloTamper := map[string]func(req *Request){
+		"version":      func(req *Request) { req.Hello.Version++ },
+		"capabilities": func(req *Request) { req.Hello.Capabilities ^= CapFilter },
+		"quota":        func(req *Request) { req.Hello.Quota++ },
+		"type":         func(req *Request) { req.Type = HelloAck },
+	}
+
+	for keyName, key := range keys {
+		ring := NewKeyRing()
+		ring.Add(peer, key)
+
+		for name, change := range tamper {
+			req := testRequests()["batch"]
+			req.Reason = ReasonAttackPersists
+			ring.Sign(&req, peer)
+			if err := ring.Verify(&req, peer); err != nil {
+				t.Fatalf("%s: untouched request failed to verify: %v", keyName, err)
+			}
+
+			change(&req)
+			if err := ring.Verify(&req, peer); err != ErrBadSignature {
+				t.Errorf("%s: changing the %s returned %v, want %v", keyName, name, err, ErrBadSignature)
+			}
+		}
+
+		for name, change := range helloTamper {
+			req := testRequests()["hello"]
+			ring.Sign(&req, peer)
+			change(&req)
+			if err := ring.Verify(&req, peer); err != ErrBadSignature {
+				t.Errorf("%s: changing the hello %s returned %v, want %v", keyName, name, err, ErrBadSignature)
+			}
+		}
+	}
+
+	req := testRequests()["hello"]
+	if err := NewKeyRing().Verify(&req, peer); err != ErrNoKey {
+		t.Errorf("verifying without a key returned %v, want %v", err, ErrNoKey)
+	}
+}
@@ -0,0 +1,101 @@
+package filter
+
+import (
+	"errors"
+	"net"
+
+	"github.com/ThomasJClark/cs4404project/aitf/routerecord"
+)
+
+/*MaxBatchSize is the most flows that one message can carry, including the
+main one.  This keeps a message from getting too big for a single datagram.*/
+const MaxBatchSize = 32
+
+var (
+	/*ErrBatchTooBig is returned when making, writing, or reading a message with
+	more than MaxBatchSize flows.*/
+	ErrBatchTooBig = errors.New("too many flows in batch")
+
+	/*ErrEmptyBatch is returned when making a batch out of no requests.*/
+	ErrEmptyBatch = errors.New("no flows in batch")
+)
+
+/*
+BatchFlow is one of the extra flows in a batched message.  A victim under a
+distributed attack can ask for many flows to be filtered at once, and routers
+can run a single counter-connection for every flow behind the same attacker's
+router.
+*/
+type BatchFlow struct {
+	SrcIP net.IP
+	DstIP net.IP
+	Flow  routerecord.RouteRecord
+}
+
+/*
+NewBatch combines several requests into one message about all of their flows.
+The type, nonce, and reason of the first request are used for the whole batch.
+At least one and at most MaxBatchSize requests can be combined.
+*/
+func NewBatch(reqs []Request) (Request, error) {
+	if len(reqs) == 0 {
+		return Request{}, ErrEmptyBatch
+	}
+
+	if len(reqs) > MaxBatchSize {
+		return Request{}, ErrBatchTooBig
+	}
+
+	batch := reqs[0]
+	batch.Batch = nil
+	for _, req := range reqs[1:] {
+		batch.Batch = append(batch.Batch, BatchFlow{SrcIP: req.SrcIP, DstIP: req.DstIP, Flow: req.Flow})
+	}
+
+	return batch, nil
+}
+
+/*Flows splits a message into a separate request for each flow it's about.  A
+message that isn't batched just returns itself.*/
+func (req *Request) Flows() []Request {
+	single := *req
+	single.Batch = nil
+
+	flows := []Request{single}
+	for _, flow := range req.Batch {
+		single.SrcIP, single.DstIP, single.Flow = flow.SrcIP, flow.DstIP, flow.Flow
+		flows = append(flows, single)
+	}
+
+	return flows
+}
+
+/*Keys returns the FlowKey of every flow that a message is about.*/
+func (req *Request) Keys() []FlowKey {
+	keys := []FlowKey{req.Key()}
+	for _, flow := range req.Batch {
+		var key FlowKey
+		copy(key.SrcIP[:], flow.SrcIP.To4())
+		copy(key.DstIP[:], flow.DstIP.To4())
+		keys = append(keys, key)
+	}
+
+	return keys
+}
+
+/*SameFlows returns true if two messages are about exactly the same flows, in
+the same order.*/
+func (req *Request) SameFlows(other *Request) bool {
+	keys, otherKeys := req.Keys(), other.Keys()
+	if len(keys) != len(otherKeys) {
+		return false
+	}
+
+	for i := range keys {
+		if keys[i] != otherKeys[i] {
+			return false
+		}
+	}
+
+	return true
+}
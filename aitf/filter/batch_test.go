@@ -0,0 +1,59 @@
+package filter
+
+import (
+	"bytes"
+	"net"
+	"testing"
+)
+
+func TestRequestBatchSize(t *testing.T) {
+	reqs := make([]Request, MaxBatchSize+1)
+	for i := range reqs {
+		reqs[i] = Request{SrcIP: net.IPv4(10, 4, 32, byte(i)), DstIP: net.IPv4(10, 4, 31, 2), Flow: testRecord()}
+	}
+
+	tests := []struct {
+		n   int
+		err error
+	}{
+		{0, ErrEmptyBatch},
+		{1, nil},
+		{MaxBatchSize, nil},
+		{MaxBatchSize + 1, ErrBatchTooBig},
+	}
+
+	for _, test := range tests {
+		batch, err := NewBatch(reqs[:test.n])
+		if err != test.err {
+			t.Errorf("NewBatch of %d requests returned %v, want %v", test.n, err, test.err)
+			continue
+		}
+
+		if err != nil {
+			continue
+		}
+
+		if len(batch.Keys()) != test.n {
+			t.Errorf("NewBatch of %d requests has %d flows", test.n, len(batch.Keys()))
+		}
+
+		var b bytes.Buffer
+		if _, err := batch.WriteTo(&b); err != nil {
+			t.Errorf("WriteTo of %d flows: %v", test.n, err)
+		}
+	}
+
+	oversized := reqs[0]
+	for _, req := range reqs[1:] {
+		oversized.Batch = append(oversized.Batch, BatchFlow{SrcIP: req.SrcIP, DstIP: req.DstIP, Flow: req.Flow})
+	}
+
+	var b bytes.Buffer
+	if _, err := oversized.WriteTo(&b); err != ErrBatchTooBig {
+		t.Errorf("WriteTo of %d flows returned %v, want %v", MaxBatchSize+1, err, ErrBatchTooBig)
+	}
+
+	if b.Len() != 0 {
+		t.Errorf("WriteTo of %d flows wrote %d bytes", MaxBatchSize+1, b.Len())
+	}
+}
@@ -0,0 +1,184 @@
+package filter
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"os/exec"
+	"strconv"
+	"strings"
+)
+
+/*ErrTableFull is returned when a filter can't be installed because the table
+is at its maximum size, and no filter could be evicted to make room.*/
+var ErrTableFull = errors.New("filter table is full")
+
+/*
+Priority is how important it is to keep a filter installed when the table runs
+out of room.  A filter is never evicted to make room for one with a lower
+priority.
+*/
+type Priority int
+
+const (
+	/*PriorityTemporary is for filters that are only in place until another
+	node takes over.*/
+	PriorityTemporary Priority = iota
+
+	/*PriorityNormal is for filters installed at a victim's request.*/
+	PriorityNormal
+
+	/*PriorityEscalated is for filters on flows that another node already failed
+	to stop, and for disconnected hosts.*/
+	PriorityEscalated
+)
+
+/*EvictionPolicy decides which filter to remove when a table is full.*/
+type EvictionPolicy int
+
+const (
+	/*EvictNone never removes filters early.  New filters are refused instead.*/
+	EvictNone EvictionPolicy = iota
+
+	/*EvictOldest removes the filter that was installed first.*/
+	EvictOldest
+
+	/*EvictLeastHit removes the filter that has dropped the fewest packets.*/
+	EvictLeastHit
+
+	/*EvictLowestPriority removes the filter with the lowest priority, or the
+	oldest one if there's a tie.*/
+	EvictLowestPriority
+)
+
+func (p EvictionPolicy) String() string {
+	switch p {
+	case EvictNone:
+		return "none"
+	case EvictOldest:
+		return "oldest"
+	case EvictLeastHit:
+		return "least-hit"
+	case EvictLowestPriority:
+		return "lowest-priority"
+	}
+
+	return "Unrecognized"
+}
+
+/*ParseEvictionPolicy returns the eviction policy with the given name, as
+returned by EvictionPolicy.String.*/
+func ParseEvictionPolicy(s string) (EvictionPolicy, error) {
+	for _, p := range []EvictionPolicy{EvictNone, EvictOldest, EvictLeastHit, EvictLowestPriority} {
+		if p.String() == s {
+			return p, nil
+		}
+	}
+
+	return EvictNone, fmt.Errorf("unknown eviction policy %q", s)
+}
+
+/*
+evict removes a filter according to the table's eviction policy to make room
+for a new filter with the given priority.  It returns false if there's nothing
+that can be removed.  The caller must hold t.mu.
+*/
+func (t *Table) evict(p Priority) bool {
+	if t.Policy == EvictNone {
+		return false
+	}
+
+	var hits map[FlowKey]uint64
+	if t.Policy == EvictLeastHit {
+		hits = t.hits()
+	}
+
+	var victim FlowKey
+	var victimFilter *installedFilter
+	for key, f := range t.filters {
+		if f.priority > p {
+			continue
+		}
+
+		if victimFilter == nil {
+			victim, victimFilter = key, f
+			continue
+		}
+
+		var better bool
+		switch t.Policy {
+		case EvictOldest:
+			better = f.installed.Before(victimFilter.installed)
+		case EvictLeastHit:
+			better = hits[key] < hits[victim]
+		case EvictLowestPriority:
+			better = f.priority < victimFilter.priority ||
+				(f.priority == victimFilter.priority && f.installed.Before(victimFilter.installed))
+		}
+
+		if better {
+			victim, victimFilter = key, f
+		}
+	}
+
+	if victimFilter == nil {
+		return false
+	}
+
+	log.Println("Filter table is full. Evicting", victim, "by", t.Policy, "policy.")
+	t.remove(victim)
+	return true
+}
+
+/*
+hits returns the number of packets dropped by each filter so far, according to
+the packet counters that iptables keeps for each rule.  The caller must hold
+t.mu.
+*/
+func (t *Table) hits() map[FlowKey]uint64 {
+	target := "OUTPUT"
+	if t.forward {
+		target = "FORWARD"
+	}
+
+	out, err := exec.Command("iptables", "-n", "-v", "-x", "-L", target).Output()
+	if err != nil {
+		log.Println(err)
+		return nil
+	}
+
+	/*Each rule is listed as: pkts bytes target prot opt in out source destination*/
+	hits := make(map[FlowKey]uint64)
+	scanner := bufio.NewScanner(bytes.NewReader(out))
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 9 || fields[2] != "DROP" {
+			continue
+		}
+
+		pkts, err := strconv.ParseUint(fields[0], 10, 64)
+		if err != nil {
+			continue
+		}
+
+		var key FlowKey
+		copy(key.SrcIP[:], parseRuleAddress(fields[7]))
+		copy(key.DstIP[:], parseRuleAddress(fields[8]))
+		hits[key] += pkts
+	}
+
+	return hits
+}
+
+/*parseRuleAddress parses an address from an iptables listing, which is either
+a single address or a network in CIDR notation.*/
+func parseRuleAddress(s string) net.IP {
+	if ip, _, err := net.ParseCIDR(s); err == nil {
+		return ip.To4()
+	}
+
+	return net.ParseIP(s).To4()
+}
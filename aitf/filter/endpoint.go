@@ -0,0 +1,145 @@
+package filter
+
+import (
+	"bytes"
+	"fmt"
+	"log"
+	"net"
+	"time"
+
+	"github.com/ThomasJClark/cs4404project/aitf"
+)
+
+/*DefaultPort is the UDP port that AITF nodes exchange filter requests on.*/
+const DefaultPort = 54321
+
+/*
+Endpoint is a UDP socket used by an AITF node to both send and receive filter
+requests.  Since every message is sent from the same socket, replies come from
+the well-known port that the node listens on.
+*/
+type Endpoint struct {
+	conn   *net.UDPConn
+	port   int
+	buf    []byte
+	replay *replayCache
+
+	/*Freshness is how far a received message's timestamp can be from the
+	current time.  Older messages are rejected as replays.*/
+	Freshness time.Duration
+
+	/*Keys are used to sign requests sent to other routers.  It may be nil if
+	nothing should be signed.*/
+	Keys *KeyRing
+}
+
+/*
+NewEndpoint opens a UDP socket bound to the given address and port.  If addr is
+empty, the socket is bound to every interface.
+
+Requests sent to other nodes by IP address alone are sent to the same port, so
+every node in a deployment should use the same one.  Several nodes can still
+share a host for testing by binding them to different addresses.
+*/
+func NewEndpoint(addr string, port int) (*Endpoint, error) {
+	udpAddr, err := net.ResolveUDPAddr("udp", net.JoinHostPort(addr, fmt.Sprint(port)))
+	if err != nil {
+		return nil, err
+	}
+
+	conn, err := net.ListenUDP("udp", udpAddr)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Endpoint{
+		conn:      conn,
+		port:      port,
+		buf:       make([]byte, 5000),
+		replay:    newReplayCache(DefaultReplayCacheSize),
+		Freshness: DefaultFreshness,
+	}, nil
+}
+
+/*Send sends a filter request to the AITF port of the given IP address.*/
+func (e *Endpoint) Send(req Request, to net.IP) error {
+	return e.SendTo(req, &net.UDPAddr{IP: to, Port: e.port})
+}
+
+/*SendTo sends a filter request to the given UDP address.  This is used to
+reply to a request on whatever port it came from.*/
+func (e *Endpoint) SendTo(req Request, to *net.UDPAddr) error {
+	log.Println("Sending", req.Type, "to", aitf.Hostname(to.IP))
+
+	/*Requests are often passed along after being received, so give each one a
+	new timestamp and ID, and get rid of any signature from the last hop.*/
+	req.Timestamp = time.Now().UnixNano()
+	req.ID = newMessageID()
+	req.Signature = nil
+	if e.Keys != nil {
+		e.Keys.Sign(&req, to.IP)
+	}
+
+	var b bytes.Buffer
+	if _, err := req.WriteTo(&b); err != nil {
+		log.Println(err)
+		return err
+	}
+
+	_, err := e.conn.WriteToUDP(b.Bytes(), to)
+	return err
+}
+
+/*
+Receive blocks until a filter request arrives, and returns it along with the
+address it came from.  An error is returned if the datagram couldn't be read or
+isn't a valid filter request, in which case the caller should simply try again.
+
+Messages are also rejected with ErrStale if their timestamp isn't fresh.
+Duplicates aren't detected here, since the message hasn't been authenticated
+yet.  Once its signature is verified, it should be passed to CheckReplay.
+
+Replay protection only covers signed messages between routers.  Nothing stops
+anyone from changing the timestamp and ID of an unsigned message, such as a
+filter request from a host, so those can still be replayed.
+
+Receive must only be called by one goroutine at a time.
+*/
+func (e *Endpoint) Receive() (req Request, addr *net.UDPAddr, err error) {
+	n, addr, err := e.conn.ReadFromUDP(e.buf)
+	if err != nil {
+		return
+	}
+
+	if _, err = req.ReadFrom(bytes.NewBuffer(e.buf[:n])); err != nil {
+		return
+	}
+
+	age := time.Since(time.Unix(0, req.Timestamp))
+	if age > e.Freshness || age < -e.Freshness {
+		err = ErrStale
+	}
+
+	return
+}
+
+/*
+CheckReplay remembers the ID of a message whose signature has been verified,
+and returns ErrReplayed if a message with the same ID was already received.
+The ID is remembered until the message goes stale.  If too many messages have
+been received within the freshness window to remember another one,
+ErrReplayCacheFull is returned, and the message should be thrown away.
+
+Only authenticated messages should be checked.  Otherwise, anyone could fill
+up the cache with made-up IDs.  CheckReplay must only be called by the same
+goroutine as Receive.
+*/
+func (e *Endpoint) CheckReplay(req *Request) error {
+	expires := time.Unix(0, req.Timestamp).Add(e.Freshness)
+	return e.replay.Add(req.ID, expires, time.Now())
+}
+
+/*Close closes the endpoint's socket.*/
+func (e *Endpoint) Close() error {
+	return e.conn.Close()
+}
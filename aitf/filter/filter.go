@@ -2,11 +2,9 @@ package filter
 
 import (
 	"fmt"
-	"log"
+	"net"
 	"os/exec"
 	"time"
-
-	"github.com/ThomasJClark/cs4404project/aitf"
 )
 
 const (
@@ -19,68 +17,53 @@ const (
 	the attacking host or a nearby router.*/
 	//LongFilterTime = 2 * time.Minute
 	LongFilterTime = 10 * time.Second
+
+	/*MaxFilterTime is the longest that a filter can be renewed for.*/
+	MaxFilterTime = 32 * LongFilterTime
 )
 
 /*
-InstallFilter adds a firewall rule to implement the requested filter. The
-filter will be removed after the specified duration has passed.
-
-If forward is true, the rule will block forwarded traffic.  This option is true
-for routers.
-
-This function returns immediately, and the rule is applied and removed
-asynchronously.
+RenewalTime returns how long a filter lasts after it has been renewed the given
+number of times.  The time doubles with each renewal, up to MaxFilterTime, so
+attackers that keep coming back are blocked for longer and longer.
 */
-func InstallFilter(req Request, d time.Duration, forward bool) {
-	log.Printf("Adding filter: [%s to %s] for %s", aitf.Hostname(req.SrcIP), aitf.Hostname(req.DstIP), d)
-
-	/*Run the iptables command to add the filter*/
-	var target string
-	if forward {
-		target = "FORWARD"
-	} else {
-		target = "OUTPUT"
+func RenewalTime(renewals int) time.Duration {
+	d := LongFilterTime
+	for i := 0; i < renewals && d < MaxFilterTime; i++ {
+		d *= 2
 	}
 
-	add := exec.Command("iptables",
-		"-I", target,
-		"-s", fmt.Sprintf("%s/32", req.SrcIP),
-		"-d", fmt.Sprintf("%s/32", req.DstIP),
-		"-j", "DROP")
-
-	remove := exec.Command("iptables",
-		"-D", target,
-		"-s", fmt.Sprintf("%s/32", req.SrcIP),
-		"-d", fmt.Sprintf("%s/32", req.DstIP),
-		"-j", "DROP")
-
-	err := add.Run()
-	if err != nil {
-		log.Println(err)
-		return
+	if d > MaxFilterTime {
+		d = MaxFilterTime
 	}
 
-	/*Uninstall the filter after sleeping for d*/
-	go func() {
-		time.Sleep(d)
-		if remove.Run() == nil {
-			log.Println("Filter timed out.")
-			log.Printf("Removing filter: [%s to %s]", aitf.Hostname(req.SrcIP), aitf.Hostname(req.DstIP))
-			return
-		}
-	}()
+	return d
+}
+
+/*
+Disconnection returns a request that covers all traffic from the given host, no
+matter where it's going.  Installing it in a Table cuts the host off entirely,
+which is the penalty for an attacker that won't comply with filter requests.
+*/
+func Disconnection(host net.IP) Request {
+	return Request{SrcIP: host, DstIP: net.IPv4zero}
 }
 
 /*
-UninstallFilter removes the firewall rule associated with the specified filter
-request.
+iptables runs an iptables command to add (-I) or delete (-D) the firewall rule
+for the filter on the given flow.  If the flow's destination is 0.0.0.0, the
+rule blocks traffic to every destination.
 
 If forward is true, the rule blocks forwarded traffic.  This option is true
 for routers.
-
-This function returns immediately, and the rule is removed asynchronously.
 */
-func UninstallFilter(req Request, forward bool) {
+func iptables(op string, key FlowKey, forward bool) error {
+	return iptablesPrefix(op, key, 32, forward)
+}
+
+/*iptablesPrefix is like iptables, but blocks every source address that shares
+the first srcLen bits with the one in key.*/
+func iptablesPrefix(op string, key FlowKey, srcLen int, forward bool) error {
 	var target string
 	if forward {
 		target = "FORWARD"
@@ -88,21 +71,14 @@ func UninstallFilter(req Request, forward bool) {
 		target = "OUTPUT"
 	}
 
-	/*Run the iptables command to remove the filter.*/
-	cmd := exec.Command("iptables",
-		"-D", target,
-		"-s", fmt.Sprintf("%s/32", req.SrcIP),
-		"-d", fmt.Sprintf("%s/32", req.DstIP),
-		"-j", "DROP")
+	dst := fmt.Sprintf("%s/32", net.IP(key.DstIP[:]))
+	if net.IP(key.DstIP[:]).Equal(net.IPv4zero) {
+		dst = "0.0.0.0/0"
+	}
 
-	go func() {
-		/*If the command fails, it's because the filter has already been removed.
-		This happens all the time, since all temporary filters are automatically
-		removed after a timeout, weather or not they have already been legitimately
-		removed.*/
-		if cmd.Run() == nil {
-			log.Printf("Removing filter: [%s to %s]", aitf.Hostname(req.SrcIP), aitf.Hostname(req.DstIP))
-			return
-		}
-	}()
+	return exec.Command("iptables",
+		op, target,
+		"-s", fmt.Sprintf("%s/%d", net.IP(key.SrcIP[:]), srcLen),
+		"-d", dst,
+		"-j", "DROP").Run()
 }
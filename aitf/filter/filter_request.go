@@ -1,20 +1,17 @@
 package filter
 
 import (
-	"bytes"
 	"encoding/binary"
 	"fmt"
 	"io"
-	"log"
 	"net"
 
-	"github.com/ThomasJClark/cs4404project/aitf"
 	"github.com/ThomasJClark/cs4404project/aitf/routerecord"
 )
 
 /*
-MessageType specifies which of the five messages involved in the filter
-request process this is.
+MessageType specifies which of the messages involved in the filter request
+process this is.
 */
 type MessageType uint8
 
@@ -38,6 +35,33 @@ const (
 	/*FilterAck is sent by an "Attacker" host to a nearby gateway router to
 	signify the host's compliance with a filter request.*/
 	FilterAck
+
+	/*FilterRefused is sent by a router that won't take over a filter, for
+	example because the alleged attacker isn't one of its customers.  The router
+	that asked may then try a router further up the path.*/
+	FilterRefused
+
+	/*FilterError is sent in response to a message that couldn't be handled,
+	such as a counter-connection ACK for a handshake that never started.*/
+	FilterError
+
+	/*FilterRevoke is sent by a victim to withdraw a filter request, for example
+	after realizing the flow wasn't an attack.  It's passed along the same path
+	as the original request, and every node removes its filter.*/
+	FilterRevoke
+
+	/*FilterRenew is sent by a victim or its router to keep a filter in place
+	for longer.  Like a revocation, it's passed along to every node filtering
+	the flow, and each one extends its filter by more each time.*/
+	FilterRenew
+
+	/*Hello is sent by a router to another router to advertise what it
+	supports, and to find out the same about the other router.*/
+	Hello
+
+	/*HelloAck is sent in reply to a hello, with the replying router's own
+	advertisement.*/
+	HelloAck
 )
 
 func (t MessageType) String() string {
@@ -52,6 +76,87 @@ func (t MessageType) String() string {
 		return "Counter-connection ACK"
 	case FilterAck:
 		return "Filter acknowledgement"
+	case FilterRefused:
+		return "Filter refusal"
+	case FilterError:
+		return "Filter error"
+	case FilterRevoke:
+		return "Filter revocation"
+	case FilterRenew:
+		return "Filter renewal"
+	case Hello:
+		return "Hello"
+	case HelloAck:
+		return "Hello acknowledgement"
+	}
+
+	return "Unrecognized"
+}
+
+/*
+Reason explains why a filter request was refused, or why a message caused an
+error.  It's only meaningful in FilterRefused and FilterError messages, except
+for ReasonAttackPersists, which is a hint in a FilterReq.
+*/
+type Reason uint8
+
+const (
+	/*ReasonNone is used in messages that aren't refusals or errors.*/
+	ReasonNone Reason = iota
+
+	/*ReasonNotOwner means the requester isn't allowed to ask for filters on
+	behalf of the victim.*/
+	ReasonNotOwner
+
+	/*ReasonNotCustomer means the alleged attacker isn't behind the router that
+	was asked to filter it.*/
+	ReasonNotCustomer
+
+	/*ReasonNoCapacity means the node doesn't have room for any more filters.*/
+	ReasonNoCapacity
+
+	/*ReasonUnknownHandshake means a counter-connection message didn't match
+	any handshake in progress.*/
+	ReasonUnknownHandshake
+
+	/*ReasonUnexpectedMessage means the node doesn't handle this type of
+	message.*/
+	ReasonUnexpectedMessage
+
+	/*ReasonRateLimited means the requester has sent too many requests
+	recently.*/
+	ReasonRateLimited
+
+	/*ReasonQuotaExceeded means the requester already has as many filters
+	installed as it's allowed.*/
+	ReasonQuotaExceeded
+
+	/*ReasonAttackPersists means the victim is asking again because the attack
+	kept going after its last request was acknowledged, so its router should
+	escalate.*/
+	ReasonAttackPersists
+)
+
+func (r Reason) String() string {
+	switch r {
+	case ReasonNone:
+		return "No reason"
+	case ReasonNotOwner:
+		return "Requester does not own the victim address"
+	case ReasonNotCustomer:
+		return "Attacker is not a customer"
+	case ReasonNoCapacity:
+		return "Out of filter capacity"
+	case ReasonUnknownHandshake:
+		return "Unknown handshake"
+	case ReasonUnexpectedMessage:
+		return "Unexpected message"
+	case ReasonRateLimited:
+		return "Too many requests"
+	case ReasonQuotaExceeded:
+		return "Filter quota exceeded"
+	case ReasonAttackPersists:
+		return "Attack persists"
 	}
 
 	return "Unrecognized"
@@ -60,11 +165,48 @@ func (t MessageType) String() string {
 /*Request contains the information passed around by a victim, routers,
 and an attacker during the process of a filter request.*/
 type Request struct {
-	Type  MessageType
-	SrcIP net.IP /*The alleged attacker*/
-	DstIP net.IP /*The alleged victim*/
-	Nonce uint64 /*Used in the three-way handshake between routers*/
-	Flow  routerecord.RouteRecord
+	Type   MessageType
+	SrcIP  net.IP /*The alleged attacker*/
+	DstIP  net.IP /*The alleged victim*/
+	Nonce  uint64 /*Used in the three-way handshake between routers*/
+	Reason Reason /*Why a request was refused or caused an error*/
+	Flow   routerecord.RouteRecord
+
+	/*Batch has any other flows that the message is also about*/
+	Batch []BatchFlow
+
+	/*Hello is what a router advertises about itself.  It's only sent in Hello
+	and HelloAck messages.*/
+	Hello HelloInfo
+
+	/*Timestamp and ID are set fresh every time a message is sent, so receivers
+	can tell if it's being replayed.  Timestamp is in Unix nanoseconds.  They're
+	only protected by the signature, so they don't stop unsigned messages from
+	being replayed.*/
+	Timestamp int64
+	ID        uint64
+
+	/*Signature authenticates messages between routers that share a key*/
+	Signature []byte
+}
+
+/*FlowKey identifies the flow that a filter request is about.  Unlike a
+Request, it can be compared with == and used as a map key.*/
+type FlowKey struct {
+	SrcIP [4]byte
+	DstIP [4]byte
+}
+
+func (key FlowKey) String() string {
+	return fmt.Sprintf("[%s to %s]", net.IP(key.SrcIP[:]), net.IP(key.DstIP[:]))
+}
+
+/*Key returns the FlowKey for the flow that a filter request is about.*/
+func (req *Request) Key() FlowKey {
+	var key FlowKey
+	copy(key.SrcIP[:], req.SrcIP.To4())
+	copy(key.DstIP[:], req.DstIP.To4())
+	return key
 }
 
 /*Authentic checks if a filter request was made by a host that legitimately
@@ -72,26 +214,48 @@ received traffice through this router.
 
 This is verified by checking each router in the path until a matching one with
 an authentic nonce is found.  If no such router can be found in the path, the
-filter request is assumed to be mmalicious.*/
+filter request is assumed to be mmalicious.  In a batch, every flow must be
+authentic.*/
 func (req *Request) Authentic() bool {
-	for _, router := range req.Flow.Path {
-		if router.Authentic(req.DstIP) {
-			return true
+	for _, flow := range req.Flows() {
+		if !flow.Flow.Authentic(flow.DstIP) {
+			return false
 		}
 	}
 
-	return false
+	return true
 }
 
 /*
-WriteTo writes a filter request in its binary format into w
+WriteTo writes a filter request in its binary format into w.  Nothing is written
+if the request has more than MaxBatchSize flows.
 */
 func (req *Request) WriteTo(w io.Writer) (n int64, err error) {
+	if len(req.Batch) >= MaxBatchSize {
+		return 0, ErrBatchTooBig
+	}
+
 	binary.Write(w, binary.BigEndian, req.Type)
 	binary.Write(w, binary.BigEndian, req.SrcIP.To4())
 	binary.Write(w, binary.BigEndian, req.DstIP.To4())
 	binary.Write(w, binary.BigEndian, req.Nonce)
+	binary.Write(w, binary.BigEndian, req.Reason)
+	binary.Write(w, binary.BigEndian, req.Timestamp)
+	binary.Write(w, binary.BigEndian, req.ID)
+	if req.Type == Hello || req.Type == HelloAck {
+		binary.Write(w, binary.BigEndian, req.Hello)
+	}
+
 	req.Flow.WriteTo(w)
+	binary.Write(w, binary.BigEndian, uint8(len(req.Batch)))
+	for _, flow := range req.Batch {
+		binary.Write(w, binary.BigEndian, flow.SrcIP.To4())
+		binary.Write(w, binary.BigEndian, flow.DstIP.To4())
+		flow.Flow.WriteTo(w)
+	}
+
+	binary.Write(w, binary.BigEndian, uint8(len(req.Signature)))
+	w.Write(req.Signature)
 
 	return 0, nil
 }
@@ -118,28 +282,61 @@ func (req *Request) ReadFrom(r io.Reader) (n int64, err error) {
 		return
 	}
 
-	return req.Flow.ReadFrom(r)
-}
+	if err = binary.Read(r, binary.BigEndian, &req.Reason); err != nil {
+		return
+	}
 
-/*
-Send sends the given filter.Request over UDP port 54321 to the given
-IP address.
-*/
-func (req Request) Send(to net.IP) error {
-	log.Println("Sending", req.Type, "to", aitf.Hostname(to))
+	if err = binary.Read(r, binary.BigEndian, &req.Timestamp); err != nil {
+		return
+	}
+
+	if err = binary.Read(r, binary.BigEndian, &req.ID); err != nil {
+		return
+	}
 
-	udpAddr, err := net.ResolveUDPAddr("udp", fmt.Sprintf("%s:54321", to))
-	if err != nil {
-		return err
+	if req.Type == Hello || req.Type == HelloAck {
+		if err = binary.Read(r, binary.BigEndian, &req.Hello); err != nil {
+			return
+		}
 	}
 
-	udpConn, err := net.DialUDP("udp", nil, udpAddr)
-	if err != nil {
-		return err
+	if _, err = req.Flow.ReadFrom(r); err != nil {
+		return
+	}
+
+	var batchLen uint8
+	if err = binary.Read(r, binary.BigEndian, &batchLen); err != nil {
+		return
+	}
+
+	if int(batchLen) >= MaxBatchSize {
+		err = ErrBatchTooBig
+		return
+	}
+
+	req.Batch = nil
+	for i := 0; i < int(batchLen); i++ {
+		var flow BatchFlow
+		var flowAddresses [8]byte
+		if err = binary.Read(r, binary.BigEndian, &flowAddresses); err != nil {
+			return
+		}
+
+		flow.SrcIP = net.IP(flowAddresses[:4])
+		flow.DstIP = net.IP(flowAddresses[4:])
+		if _, err = flow.Flow.ReadFrom(r); err != nil {
+			return
+		}
+
+		req.Batch = append(req.Batch, flow)
+	}
+
+	var sigLen uint8
+	if err = binary.Read(r, binary.BigEndian, &sigLen); err != nil {
+		return
 	}
 
-	var b bytes.Buffer
-	req.WriteTo(&b)
-	b.WriteTo(udpConn)
-	return nil
+	req.Signature = make([]byte, sigLen)
+	_, err = io.ReadFull(r, req.Signature)
+	return
 }
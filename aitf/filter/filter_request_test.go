@@ -0,0 +1,78 @@
+package filter
+
+import (
+	"bytes"
+	"net"
+	"reflect"
+	"testing"
+
+	"github.com/ThomasJClark/cs4404project/aitf/routerecord"
+)
+
+func testRecord(routers ...string) routerecord.RouteRecord {
+	record := routerecord.NewRouteRecord()
+	for i, ip := range routers {
+		record.AddRouter(routerecord.Router{IP: net.ParseIP(ip).To4(), Nonce: [8]byte{byte(i), 1, 2, 3, 4, 5, 6, 7}})
+	}
+
+	return record
+}
+
+func testRequests() map[string]Request {
+	return map[string]Request{
+		"filter request": {
+			Type:      FilterReq,
+			SrcIP:     net.ParseIP("10.4.32.4").To4(),
+			DstIP:     net.ParseIP("10.4.31.2").To4(),
+			Nonce:     0x0123456789abcdef,
+			Reason:    ReasonAttackPersists,
+			Flow:      testRecord("10.4.32.3", "10.4.31.3"),
+			Timestamp: 1445000000000000000,
+			ID:        42,
+		},
+		"batch": {
+			Type:  CounterConnectionSyn,
+			SrcIP: net.ParseIP("10.4.32.4").To4(),
+			DstIP: net.ParseIP("10.4.31.2").To4(),
+			Flow:  testRecord("10.4.32.3"),
+			Batch: []BatchFlow{
+				{SrcIP: net.ParseIP("10.4.32.5").To4(), DstIP: net.ParseIP("10.4.31.2").To4(), Flow: testRecord("10.4.32.3")},
+				{SrcIP: net.ParseIP("10.4.32.6").To4(), DstIP: net.ParseIP("10.4.31.2").To4(), Flow: testRecord()},
+			},
+			Timestamp: 1,
+			ID:        2,
+			Signature: []byte{1, 2, 3},
+		},
+		"hello":     NewHello(Hello, HelloInfo{Version: ProtocolVersion, Capabilities: CapFilter | CapBatch, Quota: 100}),
+		"hello ack": NewHello(HelloAck, HelloInfo{Version: ProtocolVersion, Capabilities: CapSigned}),
+	}
+}
+
+func TestRequestRoundTrip(t *testing.T) {
+	for name, req := range testRequests() {
+		req.SrcIP, req.DstIP = req.SrcIP.To4(), req.DstIP.To4()
+		if req.Signature == nil {
+			req.Signature = []byte{}
+		}
+
+		var b bytes.Buffer
+		if _, err := req.WriteTo(&b); err != nil {
+			t.Errorf("%s: WriteTo: %v", name, err)
+			continue
+		}
+
+		var got Request
+		if _, err := got.ReadFrom(&b); err != nil {
+			t.Errorf("%s: ReadFrom: %v", name, err)
+			continue
+		}
+
+		if !reflect.DeepEqual(got, req) {
+			t.Errorf("%s: read back %+v, want %+v", name, got, req)
+		}
+
+		if b.Len() != 0 {
+			t.Errorf("%s: %d bytes left over", name, b.Len())
+		}
+	}
+}
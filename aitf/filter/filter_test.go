@@ -0,0 +1,26 @@
+package filter
+
+import (
+	"testing"
+	"time"
+)
+
+func TestRenewalTime(t *testing.T) {
+	tests := []struct {
+		renewals int
+		want     time.Duration
+	}{
+		{0, LongFilterTime},
+		{1, 2 * LongFilterTime},
+		{2, 4 * LongFilterTime},
+		{5, 32 * LongFilterTime},
+		{6, MaxFilterTime},
+		{1000, MaxFilterTime},
+	}
+
+	for _, test := range tests {
+		if got := RenewalTime(test.renewals); got != test.want {
+			t.Errorf("RenewalTime(%d) = %v, want %v", test.renewals, got, test.want)
+		}
+	}
+}
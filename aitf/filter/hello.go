@@ -0,0 +1,72 @@
+package filter
+
+import (
+	"net"
+	"strings"
+
+	"github.com/ThomasJClark/cs4404project/aitf/routerecord"
+)
+
+/*ProtocolVersion is the version of the filter protocol that this
+implementation speaks.  It's advertised in hello messages.*/
+const ProtocolVersion = 1
+
+/*Capability is a set of optional parts of the protocol that a router
+supports.*/
+type Capability uint16
+
+const (
+	/*CapFilter means the router takes over filters for its customers when asked
+	with a counter-connection.*/
+	CapFilter Capability = 1 << iota
+
+	/*CapBatch means the router accepts batched counter-connections.*/
+	CapBatch
+
+	/*CapSigned means the router signs its messages to peers that it shares a
+	key with.*/
+	CapSigned
+)
+
+func (c Capability) String() string {
+	var names []string
+	if c&CapFilter != 0 {
+		names = append(names, "filter")
+	}
+
+	if c&CapBatch != 0 {
+		names = append(names, "batch")
+	}
+
+	if c&CapSigned != 0 {
+		names = append(names, "signed")
+	}
+
+	if len(names) == 0 {
+		return "none"
+	}
+
+	return strings.Join(names, ",")
+}
+
+/*
+HelloInfo is what a router advertises about itself in hello messages, so other
+routers know whether it's worth asking it to take over a filter.
+*/
+type HelloInfo struct {
+	Version      uint8
+	Capabilities Capability
+	Quota        uint32 /*The most filters that one router can have it handle at once*/
+}
+
+/*NewHello creates a hello message, or a reply to one if t is HelloAck, that
+advertises the given information.*/
+func NewHello(t MessageType, info HelloInfo) Request {
+	return Request{
+		Type:  t,
+		SrcIP: net.IPv4zero,
+		DstIP: net.IPv4zero,
+		Flow:  routerecord.NewRouteRecord(),
+		Hello: info,
+	}
+}
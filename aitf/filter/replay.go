@@ -0,0 +1,105 @@
+package filter
+
+import (
+	"container/heap"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"time"
+)
+
+const (
+	/*DefaultFreshness is how old (or how far in the future) a message's
+	timestamp can be before it's rejected.  This has to allow for some clock
+	skew between nodes.*/
+	DefaultFreshness = 10 * time.Second
+
+	/*DefaultReplayCacheSize is how many message IDs are remembered for detecting
+	duplicates.  It should be more than the number of signed messages expected
+	within the freshness window.*/
+	DefaultReplayCacheSize = 65536
+)
+
+var (
+	/*ErrStale is returned when a message's timestamp is outside of the
+	freshness window.*/
+	ErrStale = errors.New("stale message")
+
+	/*ErrReplayed is returned when a message with the same ID was already
+	received.*/
+	ErrReplayed = errors.New("replayed message")
+
+	/*ErrReplayCacheFull is returned when there's no room to remember another
+	message ID, because every ID in the cache is still fresh.*/
+	ErrReplayCacheFull = errors.New("replay cache full")
+)
+
+/*
+replayCache remembers the IDs of recently received messages.  Messages older
+than the freshness window are rejected anyway, so each ID is only remembered
+until its message goes stale.  The cache holds a fixed number of IDs.  Once
+it's full of IDs that are still fresh, new messages are rejected instead of
+pushing old IDs out, since otherwise a flood of messages could make us forget
+a message that's about to be replayed.
+*/
+type replayCache struct {
+	max     int
+	seen    map[uint64]bool
+	expires replayHeap
+}
+
+func newReplayCache(size int) *replayCache {
+	return &replayCache{max: size, seen: make(map[uint64]bool)}
+}
+
+/*
+Add remembers the ID of a message that goes stale at the given time.  It
+returns ErrReplayed if the ID is already in the cache, or ErrReplayCacheFull if
+there's no room for it.
+*/
+func (c *replayCache) Add(id uint64, expires, now time.Time) error {
+	for len(c.expires) > 0 && !c.expires[0].expires.After(now) {
+		delete(c.seen, heap.Pop(&c.expires).(replayEntry).id)
+	}
+
+	if c.seen[id] {
+		return ErrReplayed
+	}
+
+	if len(c.expires) >= c.max {
+		return ErrReplayCacheFull
+	}
+
+	c.seen[id] = true
+	heap.Push(&c.expires, replayEntry{id: id, expires: expires})
+	return nil
+}
+
+/*replayEntry is a message ID in a replayCache, and when it can be forgotten.*/
+type replayEntry struct {
+	id      uint64
+	expires time.Time
+}
+
+/*replayHeap is a heap of the IDs in a replayCache, with the one that expires
+first on top.*/
+type replayHeap []replayEntry
+
+func (h replayHeap) Len() int            { return len(h) }
+func (h replayHeap) Less(i, j int) bool  { return h[i].expires.Before(h[j].expires) }
+func (h replayHeap) Swap(i, j int)       { h[i], h[j] = h[j], h[i] }
+func (h *replayHeap) Push(x interface{}) { *h = append(*h, x.(replayEntry)) }
+
+func (h *replayHeap) Pop() interface{} {
+	old := *h
+	entry := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return entry
+}
+
+/*newMessageID returns a random ID for a message.*/
+func newMessageID() uint64 {
+	var id uint64
+	binary.Read(rand.Reader, binary.BigEndian, &id)
+	return id
+}
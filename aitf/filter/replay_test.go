@@ -0,0 +1,42 @@
+package filter
+
+import (
+	"testing"
+	"time"
+)
+
+func TestReplayCache(t *testing.T) {
+	start := time.Now()
+	c := newReplayCache(3)
+
+	tests := []struct {
+		id      uint64
+		expires time.Duration /*When the message goes stale, after start*/
+		now     time.Duration /*When the message arrives, after start*/
+		err     error
+	}{
+		{1, 10 * time.Second, 0, nil},
+		{2, 5 * time.Second, 0, nil},
+		{1, 10 * time.Second, time.Second, ErrReplayed},
+		{3, 20 * time.Second, time.Second, nil},
+		{4, 20 * time.Second, 2 * time.Second, ErrReplayCacheFull}, /*Nothing has expired yet*/
+		{1, 10 * time.Second, 3 * time.Second, ErrReplayed},        /*Still remembered while full*/
+		{4, 20 * time.Second, 6 * time.Second, nil},                /*2 has expired*/
+		{2, 5 * time.Second, 6 * time.Second, ErrReplayCacheFull},
+		{2, 15 * time.Second, 11 * time.Second, nil}, /*1 has expired*/
+		{1, 20 * time.Second, 11 * time.Second, ErrReplayCacheFull},
+		{3, 20 * time.Second, 19 * time.Second, ErrReplayed},
+		{5, 30 * time.Second, 20 * time.Second, nil}, /*Everything has expired*/
+		{3, 30 * time.Second, 20 * time.Second, nil},
+	}
+
+	for i, test := range tests {
+		if err := c.Add(test.id, start.Add(test.expires), start.Add(test.now)); err != test.err {
+			t.Errorf("%d: Add(%d) = %v, want %v", i, test.id, err, test.err)
+		}
+
+		if len(c.seen) != len(c.expires) || len(c.seen) > c.max {
+			t.Errorf("%d: cache has %d IDs and %d expiry times, want at most %d", i, len(c.seen), len(c.expires), c.max)
+		}
+	}
+}
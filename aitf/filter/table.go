@@ -0,0 +1,258 @@
+package filter
+
+import (
+	"log"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/ThomasJClark/cs4404project/aitf"
+)
+
+/*installedFilter is the state of a single firewall rule in a Table.*/
+type installedFilter struct {
+	installed time.Time
+	expires   time.Time
+	timer     *time.Timer
+	renewals  int
+	priority  Priority
+	covered   bool /*Whether the flow is blocked by a prefix filter instead of its own rule*/
+	then      time.Duration /*For temporary filters, how long to keep it if it expires*/
+}
+
+/*
+Table keeps track of the filters installed on a node.  Each flow has at most
+one firewall rule, which is removed automatically once the filter expires.
+
+There can be a maximum number of filters in the table, since firewalls can't
+hold an unlimited number of rules.  Once it's reached, a filter is evicted to
+make room for a new one according to the eviction policy.  Filters can also be
+aggregated into prefix filters, as described by Aggregation.
+
+A Table is safe to use from multiple goroutines, but Max, Policy, and
+Aggregation must be set before it's used.
+*/
+type Table struct {
+	forward    bool
+	mu         sync.Mutex
+	filters    map[FlowKey]*installedFilter
+	aggregates map[aggregateKey]*aggregateFilter
+
+	/*Max is the most filters that can be installed at once, or 0 for no limit.*/
+	Max int
+
+	/*Policy decides which filter to evict when the table is full.*/
+	Policy EvictionPolicy
+
+	/*Aggregation is the policy for combining filters into prefix filters.*/
+	Aggregation Aggregation
+}
+
+/*
+NewTable creates an empty filter table.
+
+If forward is true, the filters block forwarded traffic.  This option is true
+for routers.
+*/
+func NewTable(forward bool) *Table {
+	return &Table{
+		forward:    forward,
+		filters:    make(map[FlowKey]*installedFilter),
+		aggregates: make(map[aggregateKey]*aggregateFilter),
+	}
+}
+
+/*
+Install adds a firewall rule to block the flow in req for the given duration.
+If the flow is already blocked, the filter is kept for at least that long, and
+its priority is raised to p if it's lower.
+
+If the table is full and no filter can be evicted, ErrTableFull is returned.
+*/
+func (t *Table) Install(req Request, d time.Duration, p Priority) error {
+	key := req.Key()
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if f := t.filters[key]; f != nil {
+		f.then = 0
+		if time.Now().Add(d).After(f.expires) {
+			t.schedule(key, f, d)
+		}
+
+		if p > f.priority {
+			f.priority = p
+			t.aggregate(key)
+		}
+
+		return nil
+	}
+
+	return t.install(req, d, 0, p)
+}
+
+/*
+InstallTemporary adds a firewall rule to block the flow in req for a short time
+while another node is asked to filter it instead.  If the filter is still
+installed when d is over, nobody took over the filter in time, so it's kept for
+the longer duration "then".  Otherwise, the filter should be removed with Remove
+once it's no longer needed.
+
+If the flow is already blocked, the existing filter is left alone.
+*/
+func (t *Table) InstallTemporary(req Request, d, then time.Duration) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if t.filters[req.Key()] != nil {
+		return nil
+	}
+
+	return t.install(req, d, then, PriorityTemporary)
+}
+
+/*install adds the firewall rule for a new filter, evicting another one first if
+the table is full.  The caller must hold t.mu.*/
+func (t *Table) install(req Request, d, then time.Duration, p Priority) error {
+	key := req.Key()
+
+	if t.Max != 0 && len(t.filters) >= t.Max && !t.evict(p) {
+		log.Println("Filter table is full. Not adding", key)
+		return ErrTableFull
+	}
+
+	log.Printf("Adding filter: [%s to %s] for %s", aitf.Hostname(req.SrcIP), aitf.Hostname(req.DstIP), d)
+
+	/*If the flow is already blocked by a prefix filter, there's no need for
+	another firewall rule.*/
+	covered := t.covering(key)
+	if !covered {
+		if err := iptables("-I", key, t.forward); err != nil {
+			log.Println(err)
+			return err
+		}
+	}
+
+	f := &installedFilter{installed: time.Now(), priority: p, covered: covered, then: then}
+	t.filters[key] = f
+	t.schedule(key, f, d)
+	t.aggregate(key)
+	return nil
+}
+
+/*
+Renew extends the lifetime of the filter on a flow, which must already be
+installed.  The new lifetime is based on how many times the filter has been
+renewed, as given by RenewalTime.
+
+The new lifetime is returned, or false if the flow isn't being filtered.
+*/
+func (t *Table) Renew(key FlowKey) (time.Duration, bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	f := t.filters[key]
+	if f == nil {
+		return 0, false
+	}
+
+	f.renewals++
+	f.then = 0
+	d := RenewalTime(f.renewals)
+	t.schedule(key, f, d)
+
+	log.Printf("Renewed filter: %s for %s", key, d)
+	return d, true
+}
+
+/*Remove removes the filter on a flow, if there is one.  It returns true if the
+flow was being filtered.*/
+func (t *Table) Remove(key FlowKey) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if t.filters[key] == nil {
+		return false
+	}
+
+	t.remove(key)
+	return true
+}
+
+/*Priority returns the priority of the filter on a flow, or false if the flow
+isn't being filtered.*/
+func (t *Table) Priority(key FlowKey) (Priority, bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	f := t.filters[key]
+	if f == nil {
+		return 0, false
+	}
+
+	return f.priority, true
+}
+
+/*Len returns the number of filters that are installed.*/
+func (t *Table) Len() int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	return len(t.filters)
+}
+
+/*Contains returns true if the flow is currently being filtered.*/
+func (t *Table) Contains(key FlowKey) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	return t.filters[key] != nil
+}
+
+/*schedule sets a filter to expire after d.  The caller must hold t.mu.*/
+func (t *Table) schedule(key FlowKey, f *installedFilter, d time.Duration) {
+	f.expires = time.Now().Add(d)
+	if f.timer != nil {
+		f.timer.Stop()
+	}
+
+	f.timer = time.AfterFunc(d, func() { t.expire(key, f) })
+}
+
+/*expire removes a filter when its timer goes off, unless the filter was
+extended or replaced in the meantime.*/
+func (t *Table) expire(key FlowKey, f *installedFilter) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if t.filters[key] != f || time.Now().Before(f.expires) {
+		return
+	}
+
+	if f.then != 0 {
+		log.Printf("Temporary filter %s wasn't taken over. Keeping it for %s.", key, f.then)
+		t.schedule(key, f, f.then)
+		f.then = 0
+		return
+	}
+
+	log.Println("Filter timed out.")
+	t.remove(key)
+}
+
+/*remove deletes the firewall rule for a flow.  The caller must hold t.mu.*/
+func (t *Table) remove(key FlowKey) {
+	f := t.filters[key]
+	f.timer.Stop()
+	delete(t.filters, key)
+
+	log.Printf("Removing filter: [%s to %s]", aitf.Hostname(net.IP(key.SrcIP[:])), aitf.Hostname(net.IP(key.DstIP[:])))
+	if !f.covered {
+		if err := iptables("-D", key, t.forward); err != nil {
+			log.Println(err)
+		}
+	}
+
+	t.release(key)
+}
@@ -0,0 +1,53 @@
+package aitf
+
+import (
+	"net"
+	"strings"
+)
+
+/*
+PrefixList is a list of IPv4 network prefixes, such as the networks of a
+router's customers.  It implements flag.Value, so it can be read from a
+comma-separated command-line option like "10.4.32.0/28,10.4.33.0/24".
+*/
+type PrefixList []*net.IPNet
+
+func (list *PrefixList) String() string {
+	prefixes := make([]string, len(*list))
+	for i, prefix := range *list {
+		prefixes[i] = prefix.String()
+	}
+
+	return strings.Join(prefixes, ",")
+}
+
+/*Set parses a comma-separated list of prefixes and adds them to the list.*/
+func (list *PrefixList) Set(value string) error {
+	for _, s := range strings.Split(value, ",") {
+		_, prefix, err := net.ParseCIDR(strings.TrimSpace(s))
+		if err != nil {
+			return err
+		}
+
+		*list = append(*list, prefix)
+	}
+
+	return nil
+}
+
+/*Match returns the prefix in the list that contains ip, or nil if there is no
+such prefix.*/
+func (list PrefixList) Match(ip net.IP) *net.IPNet {
+	for _, prefix := range list {
+		if prefix.Contains(ip) {
+			return prefix
+		}
+	}
+
+	return nil
+}
+
+/*Contains returns true if ip is inside of any prefix in the list.*/
+func (list PrefixList) Contains(ip net.IP) bool {
+	return list.Match(ip) != nil
+}